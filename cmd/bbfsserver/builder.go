@@ -6,9 +6,14 @@ import (
 	"io/fs"
 	"log/slog"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 
 	"github.com/myhops/bbfs"
 	"github.com/myhops/bbfsserver/handlers/cache"
+	"github.com/myhops/bbfsserver/handlers/events"
+	"github.com/myhops/bbfsserver/handlers/rebuild"
 	"github.com/myhops/bbfsserver/resources"
 	"github.com/myhops/bbfsserver/server"
 )
@@ -19,54 +24,247 @@ type builder struct {
 	opts *options
 
 	bbfsCfg *bbfs.Config
+
+	// events receives the changes in the versions, can be nil.
+	events *events.Broker
+
+	// cache is shared by all versions and all builds.
+	cache *cache.Cache
+	// commitTimes provides Last-Modified for the versions.
+	commitTimes *commitTimes
+	// warmSem limits the concurrent fetches to warm the cache, nil disables warming.
+	warmSem chan struct{}
+
+	// server is the server that is in use.
+	serverMtx sync.Mutex
+	server    *server.Server
+	// refs are the refs of the versions in server.
+	refs []ref
+	// candidate is the last built server, it is used when validate accepts it.
+	candidate *candidate
+	// nextRefs are used for the next build instead of the refs from Bitbucket.
+	nextRefs []ref
+}
+
+// candidate is a server that is built but not validated yet.
+type candidate struct {
+	server *server.Server
+	refs   []ref
+	diff   *refsDiff
 }
 
 // newBuilder constructs a new builder that is not initialized yet.
 // To use this builder, call build
-func newBuilder(logger *slog.Logger, opts *options) *builder {
-	return &builder{
-		logger:  logger,
-		opts:    opts,
-		bbfsCfg: bbfsCfgFromOpts(opts),
+func newBuilder(logger *slog.Logger, opts *options) (*builder, error) {
+	c, err := cache.New(cache.Config{
+		MaxBytes:       opts.cacheSize,
+		MaxEntryBytes:  opts.cacheMaxEntrySize,
+		TTL:            opts.cacheTTL,
+		QueryAllowlist: opts.cacheQueryAllowlist,
+		Compress:       opts.compress,
+		FetchTimeout:   opts.cacheFetchTimeout,
+		DiskDir:        opts.cacheDir,
+		DiskMaxBytes:   opts.cacheDirSize,
+	}, logger)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cache: %w", err)
+	}
+	cfg := bbfsCfgFromOpts(opts)
+	b := &builder{
+		logger:      logger,
+		opts:        opts,
+		bbfsCfg:     cfg,
+		cache:       c,
+		commitTimes: newCommitTimes(cfg, logger),
+	}
+	if opts.warm {
+		b.warmSem = make(chan struct{}, opts.warmConcurrency)
 	}
+	return b, nil
 }
 
+// build builds a new handler, the first time from scratch and
+// on subsequent calls from the server in use with the changed versions.
+// The handler is used after validate accepts it.
 func (b *builder) build(ctx context.Context) (http.Handler, error) {
-	h, err := b.buildHandlerWithMiddleware(ctx)
-	if err != nil {
-		return nil, err
+	refs := b.nextRefs
+	b.nextRefs = nil
+	if refs == nil {
+		var err error
+		refs, err = getRefs(ctx, b.bbfsCfg, b.logger)
+		if err != nil {
+			return nil, fmt.Errorf("error getting tags: %w", err)
+		}
 	}
-	return h, nil
-}
 
-func (b *builder) buildHandlerWithMiddleware(ctx context.Context) (http.Handler, error) {
-	bh, err := b.buildHandler(ctx)
+	var c *candidate
+	var err error
+	if srv := b.currentServer(); srv == nil {
+		c, err = b.buildCandidateFromRefs(refs)
+	} else {
+		c = b.deriveCandidate(srv, refs)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return LogRequestMiddleware(bh.ServeHTTP, b.logger), nil
+	b.candidate = c
+	return LogRequestMiddleware(c.server.ServeHTTP, b.logger), nil
 }
 
-func (b *builder) buildHandler(_ context.Context) (http.Handler, error) {
+func (b *builder) buildCandidateFromRefs(refs []ref) (*candidate, error) {
 	allFS := bbfs.NewFS(b.bbfsCfg)
+	versions := getVersionsFromRefs(b.bbfsCfg, refs, b.commitTimes)
 
-	versions, err := getVersions(b.bbfsCfg, b.logger)
+	webFS, err := fs.Sub(resources.StaticHtmlFS, "web")
 	if err != nil {
-		return nil, fmt.Errorf("error getting tags: %w", err)
+		return nil, fmt.Errorf("error creating web sub fs: %w", err)
+	}
+
+	var vfsh *server.Server
+	vfsh = server.New(
+		b.logger,
+		allFS,
+		versions,
+		webFS,
+		resources.IndexHtmlTemplate,
+		func() (*server.IndexPageInfo, error) { return b.indexPageInfoFor(vfsh) },
+		b.opts.changePollingInterval,
+		b.cache.Middleware(),
+	)
+	return &candidate{
+		server: vfsh,
+		refs:   refs,
+		diff:   &refsDiff{},
+	}, nil
+}
+
+// deriveCandidate derives a server with the changes in the refs from srv.
+// Versions that did not change keep their FS and their cache.
+func (b *builder) deriveCandidate(srv *server.Server, refs []ref) *candidate {
+	current := make(map[string]*server.Version)
+	for _, v := range srv.GetVersions() {
+		current[v.Name] = v
+	}
+	commits := make(map[string]string, len(b.refs))
+	for _, r := range b.refs {
+		commits[r.Name] = r.CommitID
+	}
+
+	versions := make([]*server.Version, 0, len(refs))
+	for _, r := range refs {
+		if v, found := current[r.Name]; found && commits[r.Name] == r.CommitID {
+			versions = append(versions, v)
+			continue
+		}
+		versions = append(versions, newVersion(b.bbfsCfg, r, b.commitTimes))
+	}
+
+	var ns *server.Server
+	ns = srv.Derive(versions, func() (*server.IndexPageInfo, error) { return b.indexPageInfoFor(ns) })
+	return &candidate{
+		server: ns,
+		refs:   refs,
+		diff:   diffRefs(b.refs, refs),
+	}
+}
+
+// validate renders the index page and fetches the smoke paths of the new
+// and moved versions through h, the handler of the candidate.
+// The candidate is used from now on when all requests succeed.
+func (b *builder) validate(ctx context.Context, h http.Handler) error {
+	c := b.candidate
+	b.candidate = nil
+	if c == nil {
+		return fmt.Errorf("no candidate to validate")
 	}
 
-	tags, err := getTags(b.bbfsCfg, b.logger)
+	paths := []string{"/"}
+	var names []string
+	for _, r := range c.diff.Added {
+		names = append(names, r.Name)
+	}
+	for _, r := range c.diff.Moved {
+		names = append(names, r.Name)
+	}
+	info, err := getIndexPageInfo("", "", "", "", names)()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	for _, v := range info.Versions {
+		for _, p := range b.opts.smokePaths {
+			paths = append(paths, v.Path+strings.TrimPrefix(p, "/"))
+		}
+	}
+
+	for _, p := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r := httptest.NewRequestWithContext(ctx, http.MethodGet, p, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code >= http.StatusInternalServerError {
+			b.logger.Error("validation failed", slog.String("path", p), slog.Int("status", w.Code))
+			return fmt.Errorf("%s returned %d", p, w.Code)
+		}
+	}
+
+	b.serverMtx.Lock()
+	old := b.server
+	b.server = c.server
+	b.serverMtx.Unlock()
+	if old != nil {
+		old.Retire(c.server)
+	}
+	b.refs = c.refs
+	if !c.diff.Empty() {
+		b.logger.Info("versions updated", slog.Any("diff", c.diff))
+		publishDiff(b.events, c.diff)
+		// The warm-up continues after the rebuild.
+		b.warm(context.WithoutCancel(ctx), c.server, names)
+	}
+	return nil
+}
+
+// indexPageInfo returns the info for the index page of the server in use.
+func (b *builder) indexPageInfo() (*server.IndexPageInfo, error) {
+	return b.indexPageInfoFor(b.currentServer())
+}
 
-	getinfo := getIndexPageInfo(
+// indexPageInfoFor returns the info for the index page of srv.
+// The versions change during incremental rebuilds,
+// so get the names from the server.
+func (b *builder) indexPageInfoFor(srv *server.Server) (*server.IndexPageInfo, error) {
+	var names []string
+	if srv != nil {
+		names = srv.GetVersionNames()
+	}
+	return getIndexPageInfo(
 		b.opts.repoURL,
 		b.opts.title,
 		b.bbfsCfg.ProjectKey,
 		b.bbfsCfg.RepositorySlug,
-		tags,
-	)
+		names,
+	)()
+}
+
+// buildDegradedHandler builds a handler without versions that is served
+// until the first build succeeds, e.g. when Bitbucket is not available at startup.
+func (b *builder) buildDegradedHandler() (http.Handler, error) {
+	getinfo := func() (*server.IndexPageInfo, error) {
+		info, err := getIndexPageInfo(
+			b.opts.repoURL,
+			b.opts.title,
+			b.bbfsCfg.ProjectKey,
+			b.bbfsCfg.RepositorySlug,
+			nil,
+		)()
+		if err != nil {
+			return nil, err
+		}
+		info.Message = "The versions are not available at the moment, please try again later."
+		return info, nil
+	}
 
 	webFS, err := fs.Sub(resources.StaticHtmlFS, "web")
 	if err != nil {
@@ -75,13 +273,36 @@ func (b *builder) buildHandler(_ context.Context) (http.Handler, error) {
 
 	vfsh := server.New(
 		b.logger,
-		allFS,
-		versions,
+		bbfs.NewFS(b.bbfsCfg),
+		nil,
 		webFS,
 		resources.IndexHtmlTemplate,
 		getinfo,
-		b.opts.changePollingInterval,
-		cache.Middleware(10_000),
+		0,
+		nil,
 	)
-	return vfsh, nil
+	return LogRequestMiddleware(vfsh.ServeHTTP, b.logger), nil
+}
+
+// rebuild builds the handler of h for refs, so the build does not get them again.
+func (b *builder) rebuild(ctx context.Context, h *rebuild.RebuildHandler, refs []ref) error {
+	b.nextRefs = refs
+	return h.Rebuild(ctx)
+}
+
+// currentServer returns the server in use.
+func (b *builder) currentServer() *server.Server {
+	b.serverMtx.Lock()
+	defer b.serverMtx.Unlock()
+	return b.server
+}
+
+// refreshAll gives the server in use a new FS for the main branch.
+func (b *builder) refreshAll(_ context.Context) error {
+	srv := b.currentServer()
+	if srv == nil {
+		return fmt.Errorf("server not built yet")
+	}
+	srv.SetAll(bbfs.NewFS(b.bbfsCfg))
+	return nil
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/myhops/bbfsserver/server"
+)
+
+// brokenFS fails like Bitbucket returning errors.
+type brokenFS struct{}
+
+func (brokenFS) Open(name string) (fs.File, error) {
+	return nil, errors.New("internal server error")
+}
+
+func TestValidate(t *testing.T) {
+	b, err := newBuilder(slog.Default(), defaultOptions())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	srv := server.New(slog.Default(), fstest.MapFS{}, nil, fstest.MapFS{}, "{{ .Title }}",
+		b.indexPageInfo, 0, nil)
+	b.server = srv
+
+	refs := []ref{{Name: "m1/v1", CommitID: "c1"}}
+	candidateWith := func(dir fs.FS) *server.Server {
+		ns := srv.Derive([]*server.Version{{Name: "m1/v1", Dir: dir}}, b.indexPageInfo)
+		b.candidate = &candidate{
+			server: ns,
+			refs:   refs,
+			diff:   diffRefs(nil, refs),
+		}
+		return ns
+	}
+
+	broken := candidateWith(brokenFS{})
+	if err := b.validate(context.Background(), broken); err == nil {
+		t.Errorf("want error for broken version")
+	}
+	if b.currentServer() != srv {
+		t.Errorf("want old server in use")
+	}
+
+	good := candidateWith(fstest.MapFS{"m1/index.html": &fstest.MapFile{Data: []byte("report")}})
+	if err := b.validate(context.Background(), good); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if b.currentServer() != good {
+		t.Errorf("want new server in use")
+	}
+	if !slices.Equal(b.refs, refs) {
+		t.Errorf("want refs %v, got %v", refs, b.refs)
+	}
+}
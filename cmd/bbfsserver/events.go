@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/myhops/bbfsserver/handlers/events"
+	"github.com/myhops/bbfsserver/server"
+)
+
+const (
+	eventVersionAdded     = "version-added"
+	eventVersionRemoved   = "version-removed"
+	eventVersionMoved     = "version-moved"
+	eventRebuildCompleted = "rebuild-completed"
+)
+
+// versionLink is a version as shown on the index page.
+type versionLink struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// rebuildCompleted is the data of the rebuild-completed event.
+// Versions is null when the versions are not known, e.g. when the index page info failed.
+type rebuildCompleted struct {
+	ID       uint64        `json:"id"`
+	Trigger  string        `json:"trigger"`
+	Outcome  string        `json:"outcome"`
+	Error    string        `json:"error,omitempty"`
+	Versions []versionLink `json:"versions"`
+}
+
+// publishDiff publishes an event for each added, removed and moved version.
+func publishDiff(broker *events.Broker, diff *refsDiff) {
+	for _, r := range diff.Added {
+		broker.Publish(eventVersionAdded, r)
+	}
+	for _, r := range diff.Removed {
+		broker.Publish(eventVersionRemoved, r)
+	}
+	for _, r := range diff.Moved {
+		broker.Publish(eventVersionMoved, r)
+	}
+}
+
+// publishRebuild publishes the outcome of the rebuild with the versions on the index page.
+func publishRebuild(broker *events.Broker, rec rebuildRecord, info *server.IndexPageInfo) {
+	broker.Publish(eventRebuildCompleted, newRebuildCompleted(rec, info))
+}
+
+// newRebuildCompleted returns the event for rec with the versions in info,
+// info is nil when it could not be determined.
+func newRebuildCompleted(rec rebuildRecord, info *server.IndexPageInfo) rebuildCompleted {
+	e := rebuildCompleted{
+		ID:      rec.ID,
+		Trigger: rec.Trigger,
+		Outcome: rec.Outcome,
+		Error:   rec.Error,
+	}
+	if info != nil {
+		e.Versions = []versionLink{}
+		for _, v := range info.Versions {
+			e.Versions = append(e.Versions, versionLink{Name: v.Name, Path: v.Path})
+		}
+	}
+	return e
+}
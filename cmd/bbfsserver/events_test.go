@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/myhops/bbfsserver/server"
+)
+
+func TestRebuildCompletedVersions(t *testing.T) {
+	rec := rebuildRecord{ID: 1, Trigger: triggerTimer, Outcome: outcomeSucceeded}
+	noVersions, _ := getIndexPageInfo("", "", "", "", nil)()
+	for _, tc := range []struct {
+		name string
+		info *server.IndexPageInfo
+		want string
+	}{
+		// The index page removes the versions for an empty list
+		// and keeps them when the versions are not known.
+		{"no versions", noVersions, `[]`},
+		{"no info", nil, `null`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := json.Marshal(newRebuildCompleted(rec, tc.info).Versions)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if string(data) != tc.want {
+				t.Errorf("want %s, got %s", tc.want, data)
+			}
+		})
+	}
+}
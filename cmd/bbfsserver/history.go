@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	triggerTimer    = "timer"
+	triggerCallback = "callback"
+	triggerWebhook  = "webhook"
+	triggerStartup  = "startup"
+)
+
+const (
+	outcomePending   = "pending"
+	outcomeRunning   = "running"
+	outcomeSucceeded = "succeeded"
+	outcomeFailed    = "failed"
+	outcomeUnchanged = "unchanged"
+	// outcomeSkipped is a requested rebuild that did not run because the circuit is open.
+	outcomeSkipped = "skipped"
+)
+
+// rebuildRecord describes a single rebuild.
+type rebuildRecord struct {
+	ID        uint64     `json:"id"`
+	Trigger   string     `json:"trigger"`
+	Requested time.Time  `json:"requested"`
+	Start     *time.Time `json:"start,omitempty"`
+	Duration  string     `json:"duration,omitempty"`
+	Outcome   string     `json:"outcome"`
+	Error     string     `json:"error,omitempty"`
+	LatestTag string     `json:"latestTag,omitempty"`
+	Versions  int        `json:"versions"`
+}
+
+// timePtr returns a pointer to t, or nil for the zero time,
+// so omitempty leaves it out of the json.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// rebuildHistory keeps the last rebuilds.
+// The polls are kept aside until they are worth recording, see keep.
+type rebuildHistory struct {
+	mtx     sync.Mutex
+	size    int
+	records []*rebuildRecord
+	// polls are the runs of the timer that are not recorded yet.
+	polls map[uint64]*rebuildRecord
+}
+
+// newRebuildHistory returns a history that keeps size records.
+func newRebuildHistory(size int) *rebuildHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &rebuildHistory{
+		size:  size,
+		polls: map[uint64]*rebuildRecord{},
+	}
+}
+
+func (h *rebuildHistory) find(id uint64) *rebuildRecord {
+	for _, r := range h.records {
+		if r.ID == id {
+			return r
+		}
+	}
+	return h.polls[id]
+}
+
+// add adds a pending rebuild.
+func (h *rebuildHistory) add(id uint64, trigger string, requested time.Time) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.append(&rebuildRecord{
+		ID:        id,
+		Trigger:   trigger,
+		Requested: requested,
+		Outcome:   outcomePending,
+	})
+}
+
+// addPoll adds a pending poll, it is only recorded after keep.
+func (h *rebuildHistory) addPoll(id uint64, trigger string, requested time.Time) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.polls[id] = &rebuildRecord{
+		ID:        id,
+		Trigger:   trigger,
+		Requested: requested,
+		Outcome:   outcomePending,
+	}
+}
+
+// keep records the poll with id, e.g. when it found changes, failed or
+// when a client waits for it.
+func (h *rebuildHistory) keep(id uint64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if r, found := h.polls[id]; found {
+		delete(h.polls, id)
+		h.append(r)
+	}
+}
+
+// discard drops the poll with id and returns true if it was not recorded.
+func (h *rebuildHistory) discard(id uint64) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	_, found := h.polls[id]
+	delete(h.polls, id)
+	return found
+}
+
+// append adds r and drops the oldest records beyond size.
+// The caller must hold mtx.
+func (h *rebuildHistory) append(r *rebuildRecord) {
+	h.records = append(h.records, r)
+	if len(h.records) > h.size {
+		h.records = slices.Delete(h.records, 0, len(h.records)-h.size)
+	}
+}
+
+// start marks the rebuild as running.
+func (h *rebuildHistory) start(id uint64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if r := h.find(id); r != nil {
+		r.Start = timePtr(time.Now())
+		r.Outcome = outcomeRunning
+	}
+}
+
+// finish records the outcome of the rebuild.
+func (h *rebuildHistory) finish(id uint64, outcome string, err error, refs []ref) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	r := h.find(id)
+	if r == nil {
+		return
+	}
+	if r.Start != nil {
+		r.Duration = time.Since(*r.Start).String()
+	}
+	r.Outcome = outcome
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if len(refs) > 0 {
+		r.LatestTag = refs[0].Name
+	}
+	r.Versions = len(refs)
+}
+
+// list returns copies of the records, newest first.
+func (h *rebuildHistory) list() []rebuildRecord {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	res := make([]rebuildRecord, 0, len(h.records))
+	for _, r := range slices.Backward(h.records) {
+		res = append(res, *r)
+	}
+	return res
+}
+
+// get returns a copy of the record with id.
+func (h *rebuildHistory) get(id uint64) (rebuildRecord, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	r := h.find(id)
+	if r == nil {
+		return rebuildRecord{}, false
+	}
+	return *r, true
+}
+
+// handleList returns the history as json.
+func (h *rebuildHistory) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Rebuilds []rebuildRecord `json:"rebuilds"`
+	}{
+		Rebuilds: h.list(),
+	})
+}
+
+// handleGet returns the record with the id from the path as json.
+func (h *rebuildHistory) handleGet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	rec, found := h.get(id)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// writeJSON writes v as json with status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Default().Error("error writing json", slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRebuildHistory(t *testing.T) {
+	h := newRebuildHistory(2)
+
+	id1 := uint64(1)
+	h.add(id1, triggerCallback, time.Now())
+	if rec, _ := h.get(id1); rec.Outcome != outcomePending {
+		t.Errorf("want pending, got %s", rec.Outcome)
+	}
+
+	h.start(id1)
+	h.finish(id1, outcomeFailed, errors.New("bitbucket down"), []ref{{Name: "m1/v2"}, {Name: "m1/v1"}})
+	rec, found := h.get(id1)
+	if !found {
+		t.Fatalf("record %d not found", id1)
+	}
+	if rec.Outcome != outcomeFailed || rec.Error != "bitbucket down" || rec.LatestTag != "m1/v2" || rec.Versions != 2 {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+
+	id2 := uint64(2)
+	h.add(id2, triggerTimer, time.Now())
+	h.start(id2)
+	h.finish(id2, outcomeSucceeded, nil, nil)
+	id3 := uint64(3)
+	h.add(id3, triggerCallback, time.Now())
+
+	list := h.list()
+	if len(list) != 2 {
+		t.Fatalf("want 2 records, got %d", len(list))
+	}
+	if list[0].ID != id3 || list[1].ID != id2 {
+		t.Errorf("want newest first, got %d, %d", list[0].ID, list[1].ID)
+	}
+
+	// A poll is only recorded after keep.
+	id4, id5 := uint64(4), uint64(5)
+	h.addPoll(id4, triggerTimer, time.Now())
+	h.addPoll(id5, triggerTimer, time.Now())
+	h.start(id4)
+	if rec, _ := h.get(id4); rec.Outcome != outcomeRunning {
+		t.Errorf("want running, got %s", rec.Outcome)
+	}
+	h.keep(id4)
+	if h.discard(id4) {
+		t.Errorf("want record %d kept", id4)
+	}
+	if !h.discard(id5) {
+		t.Errorf("want poll %d discarded", id5)
+	}
+	list = h.list()
+	if len(list) != 2 || list[0].ID != id4 || list[1].ID != id3 {
+		t.Errorf("unexpected records: %+v", list)
+	}
+}
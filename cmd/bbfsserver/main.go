@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,7 +17,12 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/myhops/bbfsserver/handlers/auth"
+	"github.com/myhops/bbfsserver/handlers/events"
+	"github.com/myhops/bbfsserver/handlers/rebuild"
 	"github.com/myhops/bbfsserver/handlers/sideway"
+	"github.com/myhops/bbfsserver/handlers/webhook"
+	"github.com/myhops/bbfsserver/schedule"
 	"github.com/myhops/bbfsserver/server"
 
 	"github.com/myhops/bbfs"
@@ -87,20 +93,41 @@ func getIndexPageInfo(
 	}
 }
 
-func latestTagChanged(lastTag string, cfg *bbfs.Config, logger *slog.Logger) bool {
-	logger = logger.With(slog.String("method", "main.latestTagChanged"))
-	t := getLatestTag(cfg, logger)
-	if t == "" {
-		logger.Info("no tag found")
-		return false
+// errNoChanges is returned by a rebuild that found nothing to do.
+var errNoChanges = errors.New("no changes detected")
+
+// refsChanged returns the current refs and true if they differ from lastRefs.
+func refsChanged(ctx context.Context, lastRefs []ref, cfg *bbfs.Config, logger *slog.Logger) ([]ref, bool, error) {
+	logger = logger.With(slog.String("method", "main.refsChanged"))
+	refs, err := getRefs(ctx, cfg, logger)
+	if err != nil {
+		logger.Error("error getting refs", slog.String("error", err.Error()))
+		return nil, false, err
 	}
-	changed := t != "" && t != lastTag
-	if changed {
-		logger.Info("new tag found",
-			slog.String("lastTag", lastTag),
-			slog.String("newTag", t))
+	if refsFingerprint(refs) == refsFingerprint(lastRefs) {
+		return refs, false, nil
 	}
-	return changed
+	logger.Info("refs changed", slog.Any("diff", diffRefs(lastRefs, refs)))
+	return refs, true, nil
+}
+
+// headChanged returns the current default branch and true if its commit differs from lastHead.
+func headChanged(ctx context.Context, lastHead ref, cfg *bbfs.Config, logger *slog.Logger) (ref, bool, error) {
+	logger = logger.With(slog.String("method", "main.headChanged"))
+	head, err := getDefaultBranch(ctx, cfg, logger)
+	if err != nil {
+		logger.Error("error getting default branch", slog.String("error", err.Error()))
+		return lastHead, false, err
+	}
+	if head == lastHead {
+		return head, false, nil
+	}
+	logger.Info("default branch changed",
+		slog.String("branch", head.Name),
+		slog.String("oldCommit", shortCommitID(lastHead.CommitID)),
+		slog.String("newCommit", shortCommitID(head.CommitID)),
+	)
+	return head, true, nil
 }
 
 func getDryRunVersions(cfg *bbfs.Config, logger *slog.Logger) []*server.Version {
@@ -109,6 +136,61 @@ func getDryRunVersions(cfg *bbfs.Config, logger *slog.Logger) []*server.Version
 	return res
 }
 
+// newPollSchedule returns the schedule for polling Bitbucket.
+func newPollSchedule(opts *options) (*schedule.Schedule, error) {
+	entries, err := schedule.ParseEntries(opts.pollSchedule)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing poll schedule: %w", err)
+	}
+	quiet, err := schedule.ParseWindows(opts.quietHours)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing quiet hours: %w", err)
+	}
+	return &schedule.Schedule{
+		Entries:  entries,
+		Interval: opts.changePollingInterval,
+		Quiet:    quiet,
+	}, nil
+}
+
+// loadStartupSnapshot loads the snapshot from the state file,
+// it returns nil if there is no usable snapshot.
+func loadStartupSnapshot(logger *slog.Logger, opts *options) *snapshot {
+	if opts.stateFile == "" {
+		return nil
+	}
+	logger = logger.With(slog.String("stateFile", opts.stateFile))
+	snap, err := loadSnapshot(opts.stateFile)
+	if err != nil {
+		logger.Warn("no snapshot loaded", slog.String("error", err.Error()))
+		return nil
+	}
+	if !snap.matches(opts) {
+		logger.Warn("snapshot is for another repository, ignored")
+		return nil
+	}
+	logger.Info("snapshot loaded",
+		slog.Time("saved", snap.Saved),
+		slog.Int("versions", len(snap.Refs)),
+	)
+	return snap
+}
+
+// adminMiddleware returns the middleware that protects the admin routes.
+func adminMiddleware(logger *slog.Logger, opts *options) func(http.Handler) http.Handler {
+	var sources []auth.TokenSource
+	if opts.adminToken != "" {
+		sources = append(sources, auth.StaticTokens{opts.adminToken})
+	}
+	if opts.adminTokenFile != "" {
+		sources = append(sources, &auth.FileTokens{Path: opts.adminTokenFile})
+	}
+	if len(sources) == 0 {
+		logger.Warn("no admin tokens configured, admin routes are disabled")
+	}
+	return auth.Bearer(logger, sources...)
+}
+
 func bbfsCfgFromOpts(opts *options) *bbfs.Config {
 	return &bbfs.Config{
 		Host:           opts.host,
@@ -123,36 +205,155 @@ func runWithOpts(ctx context.Context, logger *slog.Logger, opts *options) error
 	ctx, stop := signal.NotifyContext(ctx, os.Kill, os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	// Create a handler that sends a signal to a channel to trigger a rebuild
-	rebuildChan := make(chan struct{}, 1)
+	// Create the polling schedule
+	polls, err := newPollSchedule(opts)
+	if err != nil {
+		return err
+	}
+
+	// Track the health of Bitbucket
+	health := newUpstreamHealth(logger, opts.changePollingInterval, opts.maxBackoff, opts.circuitFailures)
+
+	// Create a coordinator that runs the rebuilds one at a time
+	// and a trigger that requests a rebuild from it.
+	// The other hooks are set when the server is built.
+	history := newRebuildHistory(opts.rebuildHistorySize)
+	coordinator := &rebuild.Coordinator{
+		Debounce: opts.rebuildDebounce,
+		Timeout:  opts.rebuildTimeout,
+		OnTrigger: func(run rebuild.Run) {
+			// The polls are recorded when they are worth it.
+			if run.Trigger == triggerTimer {
+				history.addPoll(run.ID, run.Trigger, run.Requested)
+				return
+			}
+			history.add(run.ID, run.Trigger, run.Requested)
+		},
+		OnJoin: func(run rebuild.Run, trigger string) {
+			// The client polls the status of the run.
+			if trigger != triggerTimer {
+				history.keep(run.ID)
+			}
+		},
+	}
+	trigger := func(source string) uint64 {
+		id := coordinator.Trigger(source)
+		logger.Info("rebuild triggered", slog.String("trigger", source), slog.Uint64("id", id))
+		return id
+	}
 	rebuildhandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			history.handleList(w, r)
+			return
+		}
 		logger := logger.With(slog.String("method", "rebuildHandler"))
 		logger.Info("rebuild requested")
-		// Send a signal but fail if queue is full
-		select {
-		case rebuildChan <- struct{}{}:
-			logger.Info("sent signal to trigger rebuild")
-		default:
-			logger.Info("could not send signal to trigger requild")
-		}
+		id := trigger(triggerCallback)
+		w.Header().Set("Location", fmt.Sprintf("/api/controllers/rebuild/%d", id))
+		writeJSON(w, http.StatusAccepted, struct {
+			ID uint64 `json:"id"`
+		}{
+			ID: id,
+		})
 	}
 
-	// Build the rebuild handler
-	rebuildHandler, err := newRebuildHandler(ctx, logger, opts)
+	// Build the rebuild handler, from the snapshot if present
+	snap := loadStartupSnapshot(logger, opts)
+	broker := events.New(logger)
+	builder, err := newBuilder(logger, opts)
+	if err != nil {
+		return err
+	}
+	builder.events = broker
+	if snap != nil {
+		builder.nextRefs = snap.Refs
+	}
+	rebuildHandler, err := newRebuildHandler(ctx, logger, builder)
+	if rebuildHandler == nil {
+		return err
+	}
+	if err != nil {
+		// Keep serving and retry in the background.
+		health.failure(err)
+	}
+
+	// Serve the maintenance page instead of the content during maintenance
+	maintenance, err := newMaintenanceMode(logger, opts, rebuildHandler)
 	if err != nil {
 		return err
 	}
 
 	// Add a callback for rebuild
-	sidewayHandler := sideway.New(rebuildHandler, logger)
-	sidewayHandler.HandleFunc("/api/controllers/rebuild", rebuildhandler)
-	
+	sidewayHandler := sideway.New(maintenance, logger)
+	admin := adminMiddleware(logger, opts)
+	sidewayHandler.HandleFunc("/api/controllers/maintenance", maintenance.handleMaintenance,
+		sideway.AllowMethods(http.MethodGet, http.MethodPut), admin)
+	sidewayHandler.HandleFunc("/api/controllers/cache/purge", newPurgeHandler(logger, builder.cache),
+		sideway.AllowMethods(http.MethodPost), admin)
+	sidewayHandler.HandleFunc("/api/controllers/rebuild", rebuildhandler,
+		sideway.AllowMethods(http.MethodGet, http.MethodPost), admin)
+	sidewayHandler.HandleFunc("/api/controllers/rebuild/{id}", history.handleGet,
+		sideway.AllowMethods(http.MethodGet), admin)
+	sidewayHandler.HandleFunc("/api/health", health.handleHealth,
+		sideway.AllowMethods(http.MethodGet))
+	sidewayHandler.HandleFunc("/api/health/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !rebuildHandler.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}, sideway.AllowMethods(http.MethodGet))
+	sidewayHandler.Handle("/api/events", broker, sideway.AllowMethods(http.MethodGet))
+	sidewayHandler.HandleFunc("/api/cache/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, builder.cache.Stats())
+	}, sideway.AllowMethods(http.MethodGet))
+
 	// build the server
-	srv, err := newRebuildServer(ctx, logger, opts, sidewayHandler, rebuildHandler.Rebuild)
+	var head ref
+	if snap != nil {
+		head = snap.Head
+	}
+	rebuildFunc := func(ctx context.Context, refs []ref) error {
+		return builder.rebuild(ctx, rebuildHandler, refs)
+	}
+	srv, err := newRebuildServer(ctx, logger, opts, sidewayHandler, rebuildFunc, builder.refreshAll, builder.refs, head)
 	if err != nil {
 		return fmt.Errorf("error building server: %s", err.Error())
 	}
 
+	// persist saves the state after a successful rebuild
+	persist := func() {
+		if opts.stateFile == "" {
+			return
+		}
+		info, err := builder.indexPageInfo()
+		if err != nil {
+			logger.Error("error getting index page info", slog.String("error", err.Error()))
+		}
+		if err := saveSnapshot(opts.stateFile, &snapshot{
+			Saved:          time.Now(),
+			Host:           opts.host,
+			ProjectKey:     opts.projectKey,
+			RepositorySlug: opts.repositorySlug,
+			Refs:           srv.lastRefs(),
+			Head:           srv.lastHead(),
+			Index:          info,
+		}); err != nil {
+			logger.Error("error saving snapshot", slog.String("error", err.Error()))
+		}
+	}
+	// Add the webhook if a secret is configured
+	if opts.webhookSecret != "" {
+		sidewayHandler.Handle("POST /api/webhooks/bitbucket", webhook.New(webhook.Config{
+			Secret:         opts.webhookSecret,
+			ProjectKey:     opts.projectKey,
+			RepositorySlug: opts.repositorySlug,
+			Accept:         srv.acceptWebhookRef,
+			Trigger:        func() { trigger(triggerWebhook) },
+		}, logger))
+	}
+
 	// Start the server in the background
 	go func() {
 		logger := logger.With("goroutine", "listen and serve")
@@ -163,19 +364,118 @@ func runWithOpts(ctx context.Context, logger *slog.Logger, opts *options) error
 		logger.Info("server stopped")
 	}()
 
-	rebuild := func(msg string) {
-		logger := logger.With(slog.String("message", msg))
+	coordinator.Rebuild = func(ctx context.Context, run rebuild.Run) error {
+		logger := logger.With(slog.Uint64("id", run.ID), slog.String("trigger", run.Trigger))
+		if !health.allow() {
+			return errCircuitOpen
+		}
 		cfg := bbfsCfgFromOpts(opts)
-		if !latestTagChanged(srv.latestTag, cfg, logger) {
+		refs, changed, err := refsChanged(ctx, srv.lastRefs(), cfg, logger)
+		if err != nil {
+			return err
+		}
+		head, moved, err := headChanged(ctx, srv.lastHead(), cfg, logger)
+		if err != nil {
+			return err
+		}
+		// Retry the first build until it succeeds.
+		if !rebuildHandler.Ready() {
+			changed = true
+		}
+		if !changed && !moved {
 			logger.Info("no changes detected")
+			return errNoChanges
+		}
+		history.keep(run.ID)
+		if changed {
+			logger.Info("changes detected")
+			// rebuild the server, only the changed versions are replaced
+			logger.Info("start server rebuild")
+			if err := srv.rebuild(ctx, refs); err != nil {
+				logger.Error("error rebuilding server, keeping last good handler", slog.String("error", err.Error()))
+				return err
+			}
+		}
+		if moved {
+			logger.Info("default branch changes detected")
+			if err := srv.refreshAll(ctx, head); err != nil {
+				logger.Error("error refreshing all", slog.String("error", err.Error()))
+				return err
+			}
+		}
+		return nil
+	}
+	// finish records the outcome and tells the clients
+	finish := func(run rebuild.Run, outcome string, err error) {
+		history.finish(run.ID, outcome, err, srv.lastRefs())
+		rec, found := history.get(run.ID)
+		if !found {
 			return
 		}
-		logger.Info("changes detected")
-		// rebuild the server
-		logger.Info("start server rebuild")
-		if err := srv.rebuild(ctx); err != nil {
-			logger.Error("error rebuilding server", slog.String("error", err.Error()))
+		info, ierr := builder.indexPageInfo()
+		if ierr != nil {
+			logger.Error("error getting index page info", slog.String("error", ierr.Error()))
+			info = nil
+		}
+		publishRebuild(broker, rec, info)
+	}
+	coordinator.OnStart = func(run rebuild.Run) {
+		history.start(run.ID)
+	}
+	coordinator.OnSuccess = func(run rebuild.Run) {
+		health.success()
+		finish(run, outcomeSucceeded, nil)
+		persist()
+	}
+	coordinator.OnError = func(run rebuild.Run, err error) {
+		switch {
+		case errors.Is(err, errNoChanges):
+			health.success()
+			// The polls that did not find anything are not recorded.
+			if history.discard(run.ID) {
+				return
+			}
+			finish(run, outcomeUnchanged, nil)
+		case errors.Is(err, errCircuitOpen):
+			logger.Debug("rebuild skipped", slog.Uint64("id", run.ID), slog.String("error", err.Error()))
+			// Only the requested rebuilds are recorded, not the polls.
+			if history.discard(run.ID) {
+				return
+			}
+			finish(run, outcomeSkipped, err)
+		case errors.Is(err, rebuild.ErrValidationFailed):
+			// Bitbucket is fine, the new versions are not.
+			health.success()
+			history.keep(run.ID)
+			finish(run, outcomeFailed, err)
+		default:
+			// The server keeps serving the last good handler.
+			health.failure(err)
+			history.keep(run.ID)
+			finish(run, outcomeFailed, err)
+		}
+	}
+
+	// Run the rebuilds in the background
+	rebuildsDone := make(chan struct{})
+	go func() {
+		defer close(rebuildsDone)
+		coordinator.Run(ctx)
+	}()
+
+	// Build the versions, or reconcile the snapshot, with Bitbucket
+	trigger(triggerStartup)
+
+	// nextPoll returns the time to wait for the next poll,
+	// the backoff is used when Bitbucket fails.
+	nextPoll := func() time.Duration {
+		now := time.Now()
+		next := polls.Next(now)
+		if d, failing := health.retryDelay(); failing {
+			next = polls.Defer(now.Add(d))
 		}
+		logger.Debug("next poll", slog.Time("at", next))
+		return next.Sub(now)
 	}
 
 FOR:
@@ -183,10 +483,8 @@ FOR:
 		select {
 		case <-ctx.Done():
 			break FOR
-		case <-time.After(opts.changePollingInterval):
-			rebuild("timer triggered")
-		case <-rebuildChan:
-			rebuild("rebuild callback")
+		case <-time.After(nextPoll()):
+			coordinator.Trigger(triggerTimer)
 		}
 	}
 
@@ -196,6 +494,8 @@ FOR:
 	if ctx.Err() != nil {
 		log.Printf("error: %s", ctx.Err().Error())
 	}
+	// Wait for a running rebuild to stop
+	<-rebuildsDone
 
 	// shutdown the server and wait for 10 seconds
 	sctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -235,6 +535,8 @@ func run(
 		"projectKey", opts.projectKey,
 		"repositorySlug", opts.repositorySlug,
 		slog.Duration("pollingInterval", opts.changePollingInterval),
+		slog.String("pollSchedule", opts.pollSchedule),
+		slog.String("quietHours", opts.quietHours),
 	)
 	return runWithOpts(ctx, logger, opts)
 }
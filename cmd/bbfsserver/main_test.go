@@ -135,3 +135,44 @@ func TestIndexPage(t *testing.T) {
 	_ = bodys
 	t.Logf("status: %s", w.Result().Status)
 }
+
+func TestSetIfSetBytes(t *testing.T) {
+	for _, tc := range []struct {
+		v    string
+		want int
+	}{
+		{"", 1},
+		{"1024", 1024},
+		{"16KB", 16 << 10},
+		{"256mb", 256 << 20},
+		{"2GB", 2 << 30},
+		{"-1MB", 1},
+		{"lots", 1},
+	} {
+		got := 1
+		setIfSetBytes(tc.v, &got)
+		if got != tc.want {
+			t.Errorf("%q: want %d, got %d", tc.v, tc.want, got)
+		}
+	}
+}
+
+func TestSetIfSetTTL(t *testing.T) {
+	for _, tc := range []struct {
+		v    string
+		want time.Duration
+	}{
+		{"", time.Hour},
+		{"0", 0},
+		{"0s", 0},
+		{"10m", 10 * time.Minute},
+		{"1ms", time.Second},
+		{"forever", time.Hour},
+	} {
+		got := time.Hour
+		setIfSetTTL(tc.v, &got)
+		if got != tc.want {
+			t.Errorf("%q: want %s, got %s", tc.v, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/myhops/bbfsserver/handlers/maintenance"
+	"github.com/myhops/bbfsserver/handlers/settable"
+	"github.com/myhops/bbfsserver/resources"
+)
+
+// maintenanceMode switches the content between the normal handler and the maintenance page.
+type maintenanceMode struct {
+	logger  *slog.Logger
+	handler settable.Settable
+	content http.Handler
+	page    http.Handler
+
+	mtx     sync.Mutex
+	enabled bool
+}
+
+// newMaintenanceMode returns the switch for content,
+// the static files are served during maintenance.
+func newMaintenanceMode(logger *slog.Logger, opts *options, content http.Handler) (*maintenanceMode, error) {
+	page := resources.MaintenanceHtml
+	if opts.maintenancePage != "" {
+		var err error
+		page, err = os.ReadFile(opts.maintenancePage)
+		if err != nil {
+			return nil, fmt.Errorf("error reading maintenance page: %w", err)
+		}
+	}
+	m := &maintenanceMode{
+		logger:  logger.With(slog.String("component", "maintenanceMode")),
+		content: content,
+		page:    maintenance.New(page, opts.maintenanceRetryAfter, content, "/static/"),
+	}
+	m.handler.SetLogger(m.logger)
+	m.handler.Set(content)
+	m.set(opts.maintenance)
+	return m, nil
+}
+
+func (m *maintenanceMode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// set enables or disables the maintenance mode.
+func (m *maintenanceMode) set(enabled bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.enabled == enabled {
+		return
+	}
+	m.enabled = enabled
+	if enabled {
+		m.handler.Set(m.page)
+		m.logger.Info("maintenance mode enabled")
+		return
+	}
+	m.handler.Set(m.content)
+	m.logger.Info("maintenance mode disabled")
+}
+
+// isEnabled returns true during maintenance.
+func (m *maintenanceMode) isEnabled() bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.enabled
+}
+
+type maintenanceState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// handleMaintenance returns the state on GET and sets it on PUT.
+func (m *maintenanceMode) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var state maintenanceState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			http.Error(w, fmt.Sprintf("invalid body: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		m.set(state.Enabled)
+	}
+	writeJSON(w, http.StatusOK, maintenanceState{Enabled: m.isEnabled()})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	content := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	m, err := newMaintenanceMode(slog.Default(), defaultOptions(), content)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+	if got := status("/"); got != http.StatusOK {
+		t.Errorf("want %d, got %d", http.StatusOK, got)
+	}
+
+	w := httptest.NewRecorder()
+	m.handleMaintenance(w, httptest.NewRequest(http.MethodPut, "/api/controllers/maintenance",
+		strings.NewReader(`{"enabled":true}`)))
+	if got := w.Body.String(); got != "{\"enabled\":true}\n" {
+		t.Errorf("unexpected response %s", got)
+	}
+	if got := status("/"); got != http.StatusServiceUnavailable {
+		t.Errorf("want %d, got %d", http.StatusServiceUnavailable, got)
+	}
+	if got := status("/static/favicon-16x16.png"); got != http.StatusOK {
+		t.Errorf("want static files during maintenance, got %d", got)
+	}
+
+	m.set(false)
+	if got := status("/"); got != http.StatusOK {
+		t.Errorf("want %d, got %d", http.StatusOK, got)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	_ "embed"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,6 +21,32 @@ type options struct {
 	dryRun                string
 	repoURL               string
 	title                 string
+	webhookSecret         string
+	adminToken            string
+	adminTokenFile        string
+	rebuildHistorySize    int
+	rebuildDebounce       time.Duration
+	rebuildTimeout        time.Duration
+	smokePaths            []string
+	maintenance           bool
+	maintenancePage       string
+	maintenanceRetryAfter time.Duration
+	cacheSize             int
+	cacheMaxEntrySize     int
+	cacheTTL              time.Duration
+	cacheFetchTimeout     time.Duration
+	cacheQueryAllowlist   []string
+	cacheDir              string
+	cacheDirSize          int
+	compress              bool
+	warm                  bool
+	warmConcurrency       int
+	warmMaxFiles          int
+	maxBackoff            time.Duration
+	circuitFailures       int
+	stateFile             string
+	pollSchedule          string
+	quietHours            string
 }
 
 func defaultOptions() *options {
@@ -26,7 +54,23 @@ func defaultOptions() *options {
 		logFormat:             "json",
 		listenAddress:         ":8080",
 		changePollingInterval: 5 * time.Minute,
-		title: "BBFS Server Rocks (use env var BBFSSRV_TITLE to set the title",
+		rebuildHistorySize:    20,
+		rebuildDebounce:       2 * time.Second,
+		rebuildTimeout:        5 * time.Minute,
+		smokePaths:            []string{""},
+		maintenanceRetryAfter: 5 * time.Minute,
+		cacheSize:             256 << 20,
+		cacheMaxEntrySize:     16 << 20,
+		cacheTTL:              time.Hour,
+		cacheFetchTimeout:     time.Minute,
+		cacheDirSize:          1 << 30,
+		compress:              true,
+		warm:                  true,
+		warmConcurrency:       4,
+		warmMaxFiles:          1000,
+		maxBackoff:            30 * time.Minute,
+		circuitFailures:       5,
+		title:                 "BBFS Server Rocks (use env var BBFSSRV_TITLE to set the title",
 	}
 }
 
@@ -52,6 +96,74 @@ func setIfSetDuration(v string, dp *time.Duration) {
 	*dp = d
 }
 
+// setIfSetTTL sets dp from v if v is a valid duration, 0 means no limit.
+// Other values are at least 1 second, like setIfSetDuration.
+func setIfSetTTL(v string, dp *time.Duration) {
+	if d, err := time.ParseDuration(v); err == nil && d == 0 {
+		*dp = 0
+		return
+	}
+	setIfSetDuration(v, dp)
+}
+
+// setIfSetInt sets i from v if v is a valid positive integer.
+func setIfSetInt(v string, ip *int) {
+	if v == "" {
+		return
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 1 {
+		return
+	}
+	*ip = i
+}
+
+// setIfSetBytes sets ip from v if v is a valid positive size in bytes,
+// optionally with the suffix KB, MB or GB for multiples of 1024.
+func setIfSetBytes(v string, ip *int) {
+	v = strings.ToUpper(strings.TrimSpace(v))
+	if v == "" {
+		return
+	}
+	mult := 1
+	for suffix, m := range map[string]int{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(v, suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, suffix))
+			mult = m
+			break
+		}
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 1 {
+		return
+	}
+	*ip = i * mult
+}
+
+// setIfSetBool sets b from v if v is a valid boolean.
+func setIfSetBool(v string, bp *bool) {
+	if v == "" {
+		return
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return
+	}
+	*bp = b
+}
+
+// setIfSetList sets l from the comma separated values in v.
+func setIfSetList(v string, l *[]string) {
+	if v == "" {
+		return
+	}
+	var res []string
+	for _, s := range strings.Split(v, ",") {
+		res = append(res, strings.TrimSpace(s))
+	}
+	*l = res
+}
+
 func (o *options) fromEnv(getenv func(string) string) {
 	setIfSet(getenv("PORT"), &o.listenAddress)
 	setIfSet(getenv("BBFSSRV_LISTEN_ADDRESS"), &o.listenAddress)
@@ -63,7 +175,35 @@ func (o *options) fromEnv(getenv func(string) string) {
 	setIfSet(getenv("BBFSSRV_DRY_RUN"), &o.dryRun)
 	setIfSet(getenv("BBFSSRV_REPO_URL"), &o.repoURL)
 	setIfSet(getenv("BBFSSRV_TITLE"), &o.title)
+	setIfSet(getenv("BBFSSRV_WEBHOOK_SECRET"), &o.webhookSecret)
+	setIfSet(getenv("BBFSSRV_ADMIN_TOKEN"), &o.adminToken)
+	setIfSet(getenv("BBFSSRV_ADMIN_TOKEN_FILE"), &o.adminTokenFile)
 	setIfSetDuration(getenv("BBFSSRV_CHANGE_POLLING_INTERVAL"), &o.changePollingInterval)
+	// The documented name, the name above is kept for existing deployments.
+	setIfSetDuration(getenv("BBFSSRV_TAG_POLL_INTERVAL"), &o.changePollingInterval)
+	setIfSet(getenv("BBFSSRV_POLL_SCHEDULE"), &o.pollSchedule)
+	setIfSet(getenv("BBFSSRV_QUIET_HOURS"), &o.quietHours)
+	setIfSetInt(getenv("BBFSSRV_REBUILD_HISTORY_SIZE"), &o.rebuildHistorySize)
+	setIfSetDuration(getenv("BBFSSRV_REBUILD_DEBOUNCE"), &o.rebuildDebounce)
+	setIfSetDuration(getenv("BBFSSRV_REBUILD_TIMEOUT"), &o.rebuildTimeout)
+	setIfSetList(getenv("BBFSSRV_SMOKE_PATHS"), &o.smokePaths)
+	setIfSetBool(getenv("BBFSSRV_MAINTENANCE"), &o.maintenance)
+	setIfSet(getenv("BBFSSRV_MAINTENANCE_PAGE"), &o.maintenancePage)
+	setIfSetDuration(getenv("BBFSSRV_MAINTENANCE_RETRY_AFTER"), &o.maintenanceRetryAfter)
+	setIfSetBytes(getenv("BBFSSRV_CACHE_SIZE"), &o.cacheSize)
+	setIfSetBytes(getenv("BBFSSRV_CACHE_MAX_ENTRY_SIZE"), &o.cacheMaxEntrySize)
+	setIfSetTTL(getenv("BBFSSRV_CACHE_TTL"), &o.cacheTTL)
+	setIfSetDuration(getenv("BBFSSRV_CACHE_FETCH_TIMEOUT"), &o.cacheFetchTimeout)
+	setIfSetList(getenv("BBFSSRV_CACHE_QUERY_ALLOWLIST"), &o.cacheQueryAllowlist)
+	setIfSet(getenv("BBFSSRV_CACHE_DIR"), &o.cacheDir)
+	setIfSetBytes(getenv("BBFSSRV_CACHE_DIR_SIZE"), &o.cacheDirSize)
+	setIfSetBool(getenv("BBFSSRV_COMPRESS"), &o.compress)
+	setIfSetBool(getenv("BBFSSRV_WARM"), &o.warm)
+	setIfSetInt(getenv("BBFSSRV_WARM_CONCURRENCY"), &o.warmConcurrency)
+	setIfSetInt(getenv("BBFSSRV_WARM_MAX_FILES"), &o.warmMaxFiles)
+	setIfSetDuration(getenv("BBFSSRV_MAX_BACKOFF"), &o.maxBackoff)
+	setIfSetInt(getenv("BBFSSRV_CIRCUIT_FAILURES"), &o.circuitFailures)
+	setIfSet(getenv("BBFSSRV_STATE_FILE"), &o.stateFile)
 
 	// fix listen address if needed.
 	if o.listenAddress[0] != ':' {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/myhops/bbfsserver/handlers/cache"
+)
+
+// purgeRequest selects the cached responses to remove, exactly one field must be set.
+type purgeRequest struct {
+	URL     string `json:"url,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+	Version string `json:"version,omitempty"`
+	All     bool   `json:"all,omitempty"`
+}
+
+// purgeResponse is the result of a purge.
+type purgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+// newPurgeHandler returns the handler that removes responses from c.
+func newPurgeHandler(logger *slog.Logger, c *cache.Cache) http.HandlerFunc {
+	logger = logger.With(slog.String("handler", "purge"))
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req purgeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid body: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		set := 0
+		for _, ok := range []bool{req.URL != "", req.Prefix != "", req.Version != "", req.All} {
+			if ok {
+				set++
+			}
+		}
+		if set != 1 {
+			http.Error(w, "set one of url, prefix, version or all", http.StatusBadRequest)
+			return
+		}
+
+		var n int
+		switch {
+		case req.URL != "":
+			n = c.PurgeURL(req.URL)
+		case req.Prefix != "":
+			n = c.PurgePrefix(req.Prefix)
+		case req.Version != "":
+			n = c.PurgeVersion(req.Version)
+		default:
+			n = c.PurgeAll()
+		}
+		logger.Info("purged cache",
+			slog.String("url", req.URL),
+			slog.String("prefix", req.Prefix),
+			slog.String("version", req.Version),
+			slog.Bool("all", req.All),
+			slog.Int("purged", n),
+		)
+		writeJSON(w, http.StatusOK, purgeResponse{Purged: n})
+	}
+}
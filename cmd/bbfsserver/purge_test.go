@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/myhops/bbfsserver/handlers/cache"
+)
+
+func TestPurgeHandler(t *testing.T) {
+	c, err := cache.New(cache.Config{MaxBytes: 1 << 20}, slog.Default())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var calls int
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("report"))
+	}))
+	get := func(path string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	get("/all/a.html")
+	get("/all/b.html")
+
+	purge := newPurgeHandler(slog.Default(), c)
+	w := httptest.NewRecorder()
+	purge(w, httptest.NewRequest(http.MethodPost, "/api/controllers/cache/purge",
+		strings.NewReader(`{"url":"/all/a.html"}`)))
+	if got := w.Body.String(); got != "{\"purged\":1}\n" {
+		t.Errorf("unexpected response %s", got)
+	}
+	get("/all/a.html")
+	get("/all/b.html")
+	if calls != 3 {
+		t.Errorf("want a fetched again, got %d calls", calls)
+	}
+
+	w = httptest.NewRecorder()
+	purge(w, httptest.NewRequest(http.MethodPost, "/api/controllers/cache/purge",
+		strings.NewReader(`{"url":"/all/a.html","all":true}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
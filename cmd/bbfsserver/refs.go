@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// ref is a tag on the Bitbucket server together with the commit it points to.
+type ref struct {
+	Name     string `json:"name"`
+	CommitID string `json:"commitId"`
+}
+
+// movedRef is a ref that points to a different commit than before.
+type movedRef struct {
+	Name        string `json:"name"`
+	OldCommitID string `json:"oldCommitId"`
+	NewCommitID string `json:"newCommitId"`
+}
+
+// refsFingerprint returns a hash of the names and the commit ids of refs.
+// The order of refs does not matter.
+func refsFingerprint(refs []ref) string {
+	lines := make([]string, 0, len(refs))
+	for _, r := range refs {
+		lines = append(lines, r.Name+"\x00"+r.CommitID)
+	}
+	slices.Sort(lines)
+
+	h := sha256.New()
+	for _, l := range lines {
+		h.Write([]byte(l))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// refsDiff contains the differences between two sets of refs.
+type refsDiff struct {
+	Added   []ref
+	Removed []ref
+	Moved   []movedRef
+}
+
+// diffRefs returns what changed going from old to new.
+func diffRefs(old, new []ref) *refsDiff {
+	oldByName := make(map[string]ref, len(old))
+	for _, r := range old {
+		oldByName[r.Name] = r
+	}
+	newByName := make(map[string]ref, len(new))
+	for _, r := range new {
+		newByName[r.Name] = r
+	}
+
+	d := &refsDiff{}
+	for _, r := range new {
+		o, found := oldByName[r.Name]
+		switch {
+		case !found:
+			d.Added = append(d.Added, r)
+		case o.CommitID != r.CommitID:
+			d.Moved = append(d.Moved, movedRef{
+				Name:        r.Name,
+				OldCommitID: o.CommitID,
+				NewCommitID: r.CommitID,
+			})
+		}
+	}
+	for _, r := range old {
+		if _, found := newByName[r.Name]; !found {
+			d.Removed = append(d.Removed, r)
+		}
+	}
+	return d
+}
+
+// Empty returns true if nothing changed.
+func (d *refsDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Moved) == 0
+}
+
+// LogValue implements slog.LogValuer.
+func (d *refsDiff) LogValue() slog.Value {
+	names := func(refs []ref) []string {
+		res := make([]string, 0, len(refs))
+		for _, r := range refs {
+			res = append(res, r.Name)
+		}
+		return res
+	}
+	moved := make([]string, 0, len(d.Moved))
+	for _, m := range d.Moved {
+		moved = append(moved, m.Name+": "+shortCommitID(m.OldCommitID)+".."+shortCommitID(m.NewCommitID))
+	}
+	return slog.GroupValue(
+		slog.String("added", strings.Join(names(d.Added), ",")),
+		slog.String("removed", strings.Join(names(d.Removed), ",")),
+		slog.String("moved", strings.Join(moved, ",")),
+	)
+}
+
+// shortCommitID returns the abbreviated commit id.
+func shortCommitID(id string) string {
+	if len(id) > 11 {
+		return id[:11]
+	}
+	return id
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRefsFingerprint(t *testing.T) {
+	a := []ref{
+		{Name: "m1/v1", CommitID: "c1"},
+		{Name: "m1/v2", CommitID: "c2"},
+	}
+	b := []ref{
+		{Name: "m1/v2", CommitID: "c2"},
+		{Name: "m1/v1", CommitID: "c1"},
+	}
+	if refsFingerprint(a) != refsFingerprint(b) {
+		t.Errorf("fingerprint depends on order")
+	}
+
+	moved := []ref{
+		{Name: "m1/v1", CommitID: "c3"},
+		{Name: "m1/v2", CommitID: "c2"},
+	}
+	if refsFingerprint(a) == refsFingerprint(moved) {
+		t.Errorf("fingerprint does not detect moved ref")
+	}
+	if refsFingerprint(a) == refsFingerprint(a[1:]) {
+		t.Errorf("fingerprint does not detect removed ref")
+	}
+}
+
+func TestDiffRefs(t *testing.T) {
+	old := []ref{
+		{Name: "m1/v1", CommitID: "c1"},
+		{Name: "m1/v2", CommitID: "c2"},
+		{Name: "m1/v3", CommitID: "c3"},
+	}
+	new := []ref{
+		{Name: "m1/v4", CommitID: "c4"},
+		{Name: "m1/v2", CommitID: "c5"},
+		{Name: "m1/v3", CommitID: "c3"},
+	}
+	d := diffRefs(old, new)
+	if len(d.Added) != 1 || d.Added[0].Name != "m1/v4" {
+		t.Errorf("want m1/v4 added, got %v", d.Added)
+	}
+	if len(d.Removed) != 1 || d.Removed[0].Name != "m1/v1" {
+		t.Errorf("want m1/v1 removed, got %v", d.Removed)
+	}
+	if len(d.Moved) != 1 || d.Moved[0].Name != "m1/v2" || d.Moved[0].NewCommitID != "c5" {
+		t.Errorf("want m1/v2 moved to c5, got %v", d.Moved)
+	}
+	if !diffRefs(old, old).Empty() {
+		t.Errorf("want empty diff")
+	}
+}
+
+func TestRefsJSON(t *testing.T) {
+	// The events and the snapshot use the same names as the rest of the API.
+	for _, tc := range []struct {
+		v    any
+		want string
+	}{
+		{ref{Name: "m1/v1", CommitID: "c1"}, `{"name":"m1/v1","commitId":"c1"}`},
+		{movedRef{Name: "m1/v1", OldCommitID: "c1", NewCommitID: "c2"}, `{"name":"m1/v1","oldCommitId":"c1","newCommitId":"c2"}`},
+	} {
+		data, err := json.Marshal(tc.v)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if string(data) != tc.want {
+			t.Errorf("want %s, got %s", tc.want, data)
+		}
+	}
+}
@@ -5,21 +5,30 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/myhops/bbfs"
+	bbfsserver "github.com/myhops/bbfs/bbclient/server"
 	"github.com/myhops/bbfsserver/handlers/rebuild"
+	"github.com/myhops/bbfsserver/handlers/webhook"
 )
 
 type rebuildServer struct {
 	http.Server
 	handler http.Handler
 
-	rebuildFunc func(context.Context) error
-
-	latestTag string
-	bbfsCfg   *bbfs.Config
-	logger    *slog.Logger
+	rebuildFunc    func(context.Context, []ref) error
+	refreshAllFunc func(context.Context) error
+
+	// mtx protects refs and head.
+	mtx sync.RWMutex
+	// refs are the refs of the last successful rebuild.
+	refs []ref
+	// head is the default branch as served on /all.
+	head    ref
+	bbfsCfg *bbfs.Config
+	logger  *slog.Logger
 }
 
 type rebuildServerOption func(s *rebuildServer)
@@ -30,32 +39,24 @@ func WithMiddleware(func(next http.Handler) http.Handler) rebuildServerOption {
 	}
 }
 
-func getLatestTag(cfg *bbfs.Config, logger *slog.Logger) string {
-	tags, err := getTags(cfg, logger)
-	if err != nil {
-		return ""
-	}
-	if len(tags) == 0 {
-		return ""
-	}
-	return tags[0]
-}
-
-// newRebuildServer create a new server that supports rebuilds
+// newRebuildServer create a new server that supports rebuilds.
+// refs and head are what the handler serves at startup, they are empty
+// until the first build when there is no snapshot.
 func newRebuildServer(
 	ctx context.Context,
 	logger *slog.Logger,
 	opts *options,
 	handler http.Handler,
-	rebuildFunc func(context.Context) error,
+	rebuildFunc func(context.Context, []ref) error,
+	refreshAllFunc func(context.Context) error,
+	refs []ref,
+	head ref,
 ) (*rebuildServer, error) {
 	// baseContext for the http server
 	baseContext := func(_ net.Listener) context.Context {
 		return ctx
 	}
 
-	bbfsCfg := bbfsCfgFromOpts(opts)
-	latestTag := getLatestTag(bbfsCfg, logger)
 	srv := &rebuildServer{
 		Server: http.Server{
 			Addr:              opts.listenAddress,
@@ -63,33 +64,85 @@ func newRebuildServer(
 			BaseContext:       baseContext,
 			Handler:           handler,
 		},
-		handler:   handler,
-		latestTag: latestTag,
-		bbfsCfg:   bbfsCfg,
-		logger:    logger,
-		rebuildFunc: rebuildFunc,
+		handler:        handler,
+		refs:           refs,
+		head:           head,
+		bbfsCfg:        bbfsCfgFromOpts(opts),
+		logger:         logger,
+		rebuildFunc:    rebuildFunc,
+		refreshAllFunc: refreshAllFunc,
 	}
 
 	return srv, nil
 }
 
-// rebuild triggers a rebuild and saves the latest tag
-func (s *rebuildServer) rebuild(ctx context.Context) error {
-	// Save the latest tag
-	s.latestTag = getLatestTag(s.bbfsCfg, s.logger)
-	return s.rebuildFunc(ctx)
+// rebuild rebuilds the handler for refs and saves refs when it succeeds
+func (s *rebuildServer) rebuild(ctx context.Context, refs []ref) error {
+	if err := s.rebuildFunc(ctx, refs); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.refs = refs
+	return nil
 }
 
+// refreshAll refreshes /all and saves head when it succeeds
+func (s *rebuildServer) refreshAll(ctx context.Context, head ref) error {
+	if err := s.refreshAllFunc(ctx); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.head = head
+	return nil
+}
 
-// newRebuildHandler creates a new rebuild handler
-func newRebuildHandler(ctx context.Context, logger *slog.Logger, opts *options) (*rebuild.RebuildHandler, error) {
-	// Create the builder.
-	builder := newBuilder(logger, opts)
-	// Create the rebuild handler.
-	handler, err := rebuild.New(ctx, builder.build)
+// lastRefs returns the refs of the last successful rebuild.
+func (s *rebuildServer) lastRefs() []ref {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.refs
+}
+
+// lastHead returns the default branch as served on /all.
+func (s *rebuildServer) lastHead() ref {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.head
+}
+
+// acceptWebhookRef returns true for tags that pass tagFilter and for the default branch.
+func (s *rebuildServer) acceptWebhookRef(r webhook.Ref) bool {
+	switch r.Type {
+	case bbfsserver.TagTypeTag:
+		return tagFilter(r.DisplayID)
+	case bbfsserver.TagTypeBranch:
+		return r.DisplayID == s.lastHead().Name
+	default:
+		return false
+	}
+}
+
+// newRebuildHandler creates a new rebuild handler that uses builder.
+// It serves a degraded handler until the first build succeeds.
+// The first build only runs here when it does not need Bitbucket, i.e. with the
+// refs of the snapshot, otherwise it runs in the background after the server listens.
+func newRebuildHandler(ctx context.Context, logger *slog.Logger, builder *builder) (*rebuild.RebuildHandler, error) {
+	degraded, err := builder.buildDegradedHandler()
 	if err != nil {
 		return nil, err
 	}
+	// Create the rebuild handler.
+	handler := rebuild.NewWithFallback(degraded, builder.build)
+	handler.Validate = builder.validate
+	handler.SetLogger(logger.With(slog.String("handler", "rebuild")))
+	if builder.nextRefs == nil {
+		return handler, nil
+	}
+	if err := handler.Rebuild(ctx); err != nil {
+		logger.Warn("first build failed, serving degraded handler", slog.String("error", err.Error()))
+		return handler, err
+	}
 	return handler, nil
 }
-
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/myhops/bbfsserver/server"
+)
+
+// snapshot is the state that is saved after each successful rebuild.
+// The server loads it at startup to serve without waiting for Bitbucket.
+type snapshot struct {
+	Saved          time.Time             `json:"saved"`
+	Host           string                `json:"host"`
+	ProjectKey     string                `json:"projectKey"`
+	RepositorySlug string                `json:"repositorySlug"`
+	Refs           []ref                 `json:"refs"`
+	Head           ref                   `json:"head"`
+	Index          *server.IndexPageInfo `json:"index,omitempty"`
+}
+
+// matches returns true if the snapshot was saved for the repository in opts.
+func (s *snapshot) matches(opts *options) bool {
+	return s.Host == opts.host &&
+		s.ProjectKey == opts.projectKey &&
+		s.RepositorySlug == opts.repositorySlug
+}
+
+// loadSnapshot reads the snapshot from path.
+func loadSnapshot(path string) (*snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("error parsing snapshot: %w", err)
+	}
+	return &s, nil
+}
+
+// saveSnapshot writes the snapshot to path.
+// It writes to a temporary file first, so a crash never leaves a partial snapshot.
+func saveSnapshot(path string, s *snapshot) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating snapshot: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+	return os.Rename(f.Name(), path)
+}
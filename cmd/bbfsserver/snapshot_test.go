@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	opts := &options{
+		host:           "bitbucket.example.com",
+		projectKey:     "PRJ",
+		repositorySlug: "reports",
+	}
+	want := &snapshot{
+		Saved:          time.Now().UTC().Truncate(time.Second),
+		Host:           opts.host,
+		ProjectKey:     opts.projectKey,
+		RepositorySlug: opts.repositorySlug,
+		Refs: []ref{
+			{Name: "m1/v2", CommitID: "c2"},
+			{Name: "m1/v1", CommitID: "c1"},
+		},
+		Head: ref{Name: "main", CommitID: "c3"},
+	}
+	if err := saveSnapshot(path, want); err != nil {
+		t.Fatalf("error saving snapshot: %s", err.Error())
+	}
+
+	got, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatalf("error loading snapshot: %s", err.Error())
+	}
+	if !got.Saved.Equal(want.Saved) || !slices.Equal(got.Refs, want.Refs) || got.Head != want.Head {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+	if !got.matches(opts) {
+		t.Errorf("want snapshot to match options")
+	}
+	opts.repositorySlug = "other"
+	if got.matches(opts) {
+		t.Errorf("want snapshot not to match other repository")
+	}
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/myhops/bbfsserver/server"
 
@@ -14,9 +19,14 @@ import (
 	bbfsserver "github.com/myhops/bbfs/bbclient/server"
 )
 
-// getTags returns all tags (max 1000)
-func getTags(cfg *bbfs.Config, logger *slog.Logger) ([]string, error) {
-	logger = logger.With(slog.String("method", "getTags"))
+// tagFilter returns true if the tag is served as a version.
+func tagFilter(name string) bool {
+	return strings.Contains(name, "/")
+}
+
+// getRefs returns all tags that pass tagFilter with their commit ids (max 1000)
+func getRefs(ctx context.Context, cfg *bbfs.Config, logger *slog.Logger) ([]ref, error) {
+	logger = logger.With(slog.String("method", "getRefs"))
 	u := url.URL{
 		Scheme: "https",
 		Host:   cfg.Host,
@@ -29,7 +39,7 @@ func getTags(cfg *bbfs.Config, logger *slog.Logger) ([]string, error) {
 		AccessKey: bbfsserver.SecretString(cfg.AccessKey),
 		Logger:    logger,
 	}
-	resp, err := client.GetTags(context.Background(), &bbfsserver.GetTagsCommand{
+	resp, err := client.GetTags(ctx, &bbfsserver.GetTagsCommand{
 		ProjectKey: cfg.ProjectKey,
 		RepoSlug:   cfg.RepositorySlug,
 		Limit:      1000,
@@ -37,24 +47,204 @@ func getTags(cfg *bbfs.Config, logger *slog.Logger) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	tags := make([]string, 0, len(resp.Tags))
+	refs := make([]ref, 0, len(resp.Tags))
 	for _, tag := range resp.Tags {
-		if !strings.Contains(tag.Name, "/") {
+		if !tagFilter(tag.Name) {
 			logger.Debug("skipped tag", slog.String("name", tag.Name), slog.String("type", tag.Type))
 			continue
 		}
 		logger.Debug("adding tag", slog.String("name", tag.Name))
-		tags = append(tags, tag.Name)
+		refs = append(refs, ref{
+			Name:     tag.Name,
+			CommitID: tag.CommitID,
+		})
+	}
+	return refs, nil
+}
+
+// getTags returns all tags (max 1000)
+func getTags(cfg *bbfs.Config, logger *slog.Logger) ([]string, error) {
+	refs, err := getRefs(context.Background(), cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, 0, len(refs))
+	for _, r := range refs {
+		tags = append(tags, r.Name)
 	}
 	return tags, nil
 }
 
-func getVersions(cfg *bbfs.Config, logger *slog.Logger) ([]*server.Version, error) {
-	tags, err := getTags(cfg, logger)
+// getJSON decodes the response of a GET on the repository path elems into v.
+func getJSON(ctx context.Context, cfg *bbfs.Config, v any, elems ...string) error {
+	u := url.URL{
+		Scheme: "https",
+		Host:   cfg.Host,
+		Path: filepath.Join(append([]string{bbfs.ApiPath, bbfs.DefaultVersion,
+			"projects", cfg.ProjectKey, "repos", cfg.RepositorySlug}, elems...)...),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	client := bbfsserver.Client{
+		AccessKey: bbfsserver.SecretString(cfg.AccessKey),
+	}
+	client.AuthorizeRequest(req)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error getting versions: %s", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error getting %s: %s", path.Join(elems...), resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding %s: %w", path.Join(elems...), err)
+	}
+	return nil
+}
+
+// getDefaultBranch returns the default branch with its latest commit.
+func getDefaultBranch(ctx context.Context, cfg *bbfs.Config, logger *slog.Logger) (ref, error) {
+	logger = logger.With(slog.String("method", "getDefaultBranch"))
+	var branch struct {
+		DisplayID    string `json:"displayId"`
+		LatestCommit string `json:"latestCommit"`
+	}
+	if err := getJSON(ctx, cfg, &branch, "branches", "default"); err != nil {
+		return ref{}, err
+	}
+	logger.Debug("found default branch",
+		slog.String("name", branch.DisplayID),
+		slog.String("commit", branch.LatestCommit))
+	return ref{
+		Name:     branch.DisplayID,
+		CommitID: branch.LatestCommit,
+	}, nil
+}
+
+// getCommitTime returns the commit date of the commit with commitID.
+func getCommitTime(ctx context.Context, cfg *bbfs.Config, commitID string) (time.Time, error) {
+	var commit struct {
+		// CommitterTimestamp is in milliseconds since the epoch.
+		CommitterTimestamp int64 `json:"committerTimestamp"`
+	}
+	if err := getJSON(ctx, cfg, &commit, "commits", commitID); err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(commit.CommitterTimestamp), nil
+}
+
+// commitTimeRetry is the time a failed lookup of a commit date is kept,
+// the requests in that time do not wait for Bitbucket.
+const commitTimeRetry = time.Minute
+
+// commitTime is the lookup of the date of a commit.
+type commitTime struct {
+	// done is closed when the lookup completed.
+	done chan struct{}
+	t    time.Time
+	err  error
+	// at is the time the lookup completed.
+	at time.Time
+}
+
+// commitTimes keeps the commit dates, they are fetched when the version is built.
+type commitTimes struct {
+	logger *slog.Logger
+	// lookup gets the date of a commit.
+	lookup func(ctx context.Context, commitID string) (time.Time, error)
+
+	mtx   sync.Mutex
+	times map[string]*commitTime
+}
+
+// newCommitTimes returns an empty commitTimes that gets the dates from Bitbucket.
+func newCommitTimes(cfg *bbfs.Config, logger *slog.Logger) *commitTimes {
+	return &commitTimes{
+		logger: logger.With(slog.String("component", "commitTimes")),
+		lookup: func(ctx context.Context, commitID string) (time.Time, error) {
+			return getCommitTime(ctx, cfg, commitID)
+		},
+		times: map[string]*commitTime{},
+	}
+}
+
+// fetch starts the lookup of the date of commitID in the background,
+// unless it is known or in progress. A failed lookup is started again after commitTimeRetry.
+func (c *commitTimes) fetch(commitID string) *commitTime {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if ct, found := c.times[commitID]; found {
+		select {
+		case <-ct.done:
+			if ct.err == nil || time.Since(ct.at) < commitTimeRetry {
+				return ct
+			}
+		default:
+			return ct
+		}
+	}
+	ct := &commitTime{done: make(chan struct{})}
+	c.times[commitID] = ct
+	go func() {
+		defer close(ct.done)
+		t, err := c.lookup(context.Background(), commitID)
+		if err != nil {
+			c.logger.Warn("error getting commit time",
+				slog.String("commit", shortCommitID(commitID)),
+				slog.String("error", err.Error()))
+			t = time.Time{}
+		}
+		ct.t, ct.err, ct.at = t, err, time.Now()
+	}()
+	return ct
+}
+
+// get returns the commit date of commitID or the zero time if it is not available.
+// Concurrent callers share one lookup, they wait for it until ctx is done.
+func (c *commitTimes) get(ctx context.Context, commitID string) time.Time {
+	ct := c.fetch(commitID)
+	select {
+	case <-ct.done:
+		return ct.t
+	case <-ctx.Done():
+		return time.Time{}
 	}
-	return getVersionsFromTags(cfg, logger, tags)
+}
+
+// newVersion returns a version for r.
+// The FS is at the commit of r, so it does not change when the tag moves.
+// times provides Last-Modified, it can be nil.
+func newVersion(cfg *bbfs.Config, r ref, times *commitTimes) *server.Version {
+	c := *cfg
+	c.At = r.Name
+	if r.CommitID != "" {
+		c.At = r.CommitID
+	}
+	v := &server.Version{
+		Name:     r.Name,
+		Dir:      bbfs.NewFS(&c),
+		CommitID: r.CommitID,
+	}
+	if times != nil && r.CommitID != "" {
+		times.fetch(r.CommitID)
+		v.Modified = func(ctx context.Context) time.Time { return times.get(ctx, r.CommitID) }
+	}
+	return v
+}
+
+// getVersionsFromRefs returns a version for each ref.
+func getVersionsFromRefs(cfg *bbfs.Config, refs []ref, times *commitTimes) []*server.Version {
+	res := make([]*server.Version, 0, len(refs))
+	for _, r := range refs {
+		res = append(res, newVersion(cfg, r, times))
+	}
+	return res
 }
 
 func getVersionsFromTags(cfg *bbfs.Config, _ *slog.Logger, tags []string) ([]*server.Version, error) {
@@ -72,4 +262,3 @@ func getVersionsFromTags(cfg *bbfs.Config, _ *slog.Logger, tags []string) ([]*se
 	}
 	return res, nil
 }
-
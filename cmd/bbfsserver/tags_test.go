@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCommitTimes(t *testing.T) {
+	committed := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	ct := &commitTimes{
+		logger: slog.Default(),
+		lookup: func(ctx context.Context, commitID string) (time.Time, error) {
+			calls.Add(1)
+			<-release
+			if commitID == "bad" {
+				return time.Time{}, errors.New("bitbucket not available")
+			}
+			return committed, nil
+		},
+		times: map[string]*commitTime{},
+	}
+
+	// A request does not wait longer than its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if got := ct.get(ctx, "c0ffee"); !got.IsZero() {
+		t.Errorf("want zero time before the lookup completed, got %s", got)
+	}
+
+	// Concurrent requests share the lookup.
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := ct.get(context.Background(), "c0ffee"); !got.Equal(committed) {
+				t.Errorf("want %s, got %s", committed, got)
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("want 1 lookup, got %d", n)
+	}
+
+	// A failed lookup is not repeated for every request.
+	for range 3 {
+		if got := ct.get(context.Background(), "bad"); !got.IsZero() {
+			t.Errorf("want zero time for failed lookup, got %s", got)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("want 2 lookups, got %d", n)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// upstreamHealthy means that the last call to Bitbucket succeeded.
+	upstreamHealthy = "healthy"
+	// upstreamDegraded means that calls fail, polling backs off.
+	upstreamDegraded = "degraded"
+	// upstreamUnavailable means that the circuit is open,
+	// no calls are made until the backoff delay has passed.
+	upstreamUnavailable = "unavailable"
+)
+
+var errCircuitOpen = errors.New("bitbucket unavailable, circuit open")
+
+// upstreamHealth tracks the health of Bitbucket.
+// It computes the polling delay with exponential backoff and jitter
+// and opens the circuit after consecutive failures.
+type upstreamHealth struct {
+	logger *slog.Logger
+
+	// interval is the polling interval when healthy and the base for the backoff.
+	interval time.Duration
+	// maxDelay caps the backoff delay.
+	maxDelay time.Duration
+	// openAfter is the number of consecutive failures that opens the circuit.
+	openAfter int
+
+	now    func() time.Time
+	jitter func() float64
+
+	mtx         sync.Mutex
+	state       string
+	failures    int
+	lastError   string
+	lastSuccess time.Time
+	lastFailure time.Time
+	nextAttempt time.Time
+}
+
+// newUpstreamHealth returns a healthy upstream.
+func newUpstreamHealth(logger *slog.Logger, interval, maxDelay time.Duration, openAfter int) *upstreamHealth {
+	if maxDelay < interval {
+		maxDelay = interval
+	}
+	return &upstreamHealth{
+		logger:    logger.With(slog.String("component", "upstreamHealth")),
+		interval:  interval,
+		maxDelay:  maxDelay,
+		openAfter: openAfter,
+		now:       time.Now,
+		jitter:    rand.Float64,
+		state:     upstreamHealthy,
+	}
+}
+
+// setState changes the state and logs the transition.
+// The caller must hold mtx.
+func (u *upstreamHealth) setState(state string) {
+	if u.state == state {
+		return
+	}
+	logger := u.logger.With(
+		slog.String("from", u.state),
+		slog.String("to", state),
+		slog.Int("failures", u.failures),
+		slog.Time("nextAttempt", u.nextAttempt),
+	)
+	if state == upstreamHealthy {
+		logger.Info("bitbucket state changed")
+	} else {
+		logger.Warn("bitbucket state changed", slog.String("lastError", u.lastError))
+	}
+	u.state = state
+}
+
+// backoff returns the delay after failures consecutive failures:
+// interval doubled for each failure, capped at maxDelay,
+// with a random jitter of up to half the delay.
+func (u *upstreamHealth) backoff(failures int) time.Duration {
+	d := u.interval
+	for i := 1; i < failures && d < u.maxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, u.maxDelay)
+	return d/2 + time.Duration(u.jitter()*float64(d/2))
+}
+
+// allow returns true if a call to Bitbucket is allowed.
+// Calls are refused while the circuit is open and the backoff delay has not passed.
+func (u *upstreamHealth) allow() bool {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.state != upstreamUnavailable || !u.now().Before(u.nextAttempt)
+}
+
+// success records a successful call.
+func (u *upstreamHealth) success() {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.failures = 0
+	u.lastSuccess = u.now()
+	u.nextAttempt = time.Time{}
+	u.setState(upstreamHealthy)
+}
+
+// failure records a failed call.
+func (u *upstreamHealth) failure(err error) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.failures++
+	u.lastError = err.Error()
+	u.lastFailure = u.now()
+	u.nextAttempt = u.lastFailure.Add(u.backoff(u.failures))
+	if u.failures >= u.openAfter {
+		u.setState(upstreamUnavailable)
+		return
+	}
+	u.setState(upstreamDegraded)
+}
+
+// retryDelay returns the time to wait for the next poll
+// and true if the last call failed.
+func (u *upstreamHealth) retryDelay() (time.Duration, bool) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.state == upstreamHealthy {
+		return 0, false
+	}
+	return max(u.nextAttempt.Sub(u.now()), 0), true
+}
+
+// upstreamStatus is the json representation of upstreamHealth.
+type upstreamStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure         *time.Time `json:"lastFailure,omitempty"`
+	NextAttempt         *time.Time `json:"nextAttempt,omitempty"`
+}
+
+// status returns the current status.
+func (u *upstreamHealth) status() upstreamStatus {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return upstreamStatus{
+		State:               u.state,
+		ConsecutiveFailures: u.failures,
+		LastError:           u.lastError,
+		LastSuccess:         timePtr(u.lastSuccess),
+		LastFailure:         timePtr(u.lastFailure),
+		NextAttempt:         timePtr(u.nextAttempt),
+	}
+}
+
+// handleHealth returns the status as json.
+func (u *upstreamHealth) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Bitbucket upstreamStatus `json:"bitbucket"`
+	}{
+		Bitbucket: u.status(),
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHealth(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	u := newUpstreamHealth(slog.Default(), time.Minute, 10*time.Minute, 3)
+	u.now = func() time.Time { return now }
+	u.jitter = func() float64 { return 1 }
+
+	if _, failing := u.retryDelay(); failing {
+		t.Errorf("want not failing")
+	}
+
+	errDown := errors.New("down")
+	u.failure(errDown)
+	u.failure(errDown)
+	if st := u.status(); st.State != upstreamDegraded || st.ConsecutiveFailures != 2 {
+		t.Errorf("unexpected status: %+v", st)
+	}
+	if d, _ := u.retryDelay(); d != 2*time.Minute {
+		t.Errorf("want %v, got %v", 2*time.Minute, d)
+	}
+	if !u.allow() {
+		t.Errorf("want calls allowed when degraded")
+	}
+
+	u.failure(errDown)
+	if st := u.status(); st.State != upstreamUnavailable {
+		t.Errorf("want %s, got %s", upstreamUnavailable, st.State)
+	}
+	if u.allow() {
+		t.Errorf("want calls refused when the circuit is open")
+	}
+	now = now.Add(4 * time.Minute)
+	if !u.allow() {
+		t.Errorf("want a call allowed after the backoff delay")
+	}
+
+	// The delay is capped.
+	for range 10 {
+		u.failure(errDown)
+	}
+	if d, _ := u.retryDelay(); d != 10*time.Minute {
+		t.Errorf("want %v, got %v", 10*time.Minute, d)
+	}
+
+	u.success()
+	if st := u.status(); st.State != upstreamHealthy || st.ConsecutiveFailures != 0 {
+		t.Errorf("unexpected status: %+v", st)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/myhops/bbfsserver/server"
+)
+
+// errTooManyFiles stops the walk of a version at the maximum number of files.
+var errTooManyFiles = errors.New("too many files")
+
+// discardWriter is a response writer that drops the body, the cache keeps it.
+type discardWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
+
+func (w *discardWriter) Flush() {}
+
+// warm fetches the files of the versions with names through srv in the background,
+// so their responses are cached before the users arrive.
+// The number of concurrent fetches of all warm-ups is limited by b.warmSem.
+func (b *builder) warm(ctx context.Context, srv *server.Server, names []string) {
+	if b.warmSem == nil || len(names) == 0 {
+		return
+	}
+	info, err := getIndexPageInfo("", "", "", "", names)()
+	if err != nil {
+		b.logger.Error("error getting paths to warm", slog.String("error", err.Error()))
+		return
+	}
+	paths := make(map[string]string, len(info.Versions))
+	for _, v := range info.Versions {
+		paths[v.Name] = v.Path
+	}
+	for _, v := range srv.GetVersions() {
+		if p, found := paths[v.Name]; found {
+			go b.warmVersion(ctx, srv, v, p)
+		}
+	}
+}
+
+// warmVersion fetches the files of version through h, the path of the version is prefix.
+// The landing page and the smoke paths come first, the users open them first.
+func (b *builder) warmVersion(ctx context.Context, h http.Handler, version *server.Version, prefix string) {
+	logger := b.logger.With(slog.String("method", "warmVersion"), slog.String("version", version.Name))
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	files, failed := 0, 0
+	seen := map[string]bool{}
+	// fetch fetches p, the path in the version, in the background.
+	fetch := func(p string) error {
+		if seen[p] {
+			return nil
+		}
+		if files >= b.opts.warmMaxFiles {
+			return errTooManyFiles
+		}
+		seen[p] = true
+		files++
+
+		select {
+		case b.warmSem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-b.warmSem }()
+			u := url.URL{Path: prefix + p}
+			w := &discardWriter{header: http.Header{}}
+			h.ServeHTTP(w, httptest.NewRequestWithContext(ctx, http.MethodGet, u.RequestURI(), nil))
+			if w.code >= http.StatusBadRequest {
+				mtx.Lock()
+				failed++
+				mtx.Unlock()
+			}
+		}()
+		return nil
+	}
+
+	var err error
+	for _, p := range append([]string{""}, b.opts.smokePaths...) {
+		if err = fetch(strings.TrimPrefix(p, "/")); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = fs.WalkDir(version.Dir, ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			// The file server redirects index.html to the directory.
+			if path.Base(p) == "index.html" {
+				p = strings.TrimSuffix(p, "index.html")
+			}
+			return fetch(p)
+		})
+	}
+	wg.Wait()
+	if err != nil && !errors.Is(err, errTooManyFiles) {
+		logger.Error("error warming version", slog.String("error", err.Error()))
+	}
+	logger.Info("warmed version",
+		slog.Int("files", files),
+		slog.Int("failed", failed),
+		slog.Bool("truncated", errors.Is(err, errTooManyFiles)),
+		slog.Duration("duration", time.Since(start)),
+	)
+}
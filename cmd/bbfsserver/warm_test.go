@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/myhops/bbfsserver/server"
+)
+
+func TestWarmVersion(t *testing.T) {
+	opts := defaultOptions()
+	opts.warmMaxFiles = 3
+	b, err := newBuilder(slog.Default(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	var mtx sync.Mutex
+	var paths []string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		paths = append(paths, r.URL.Path)
+		mtx.Unlock()
+	})
+	v := &server.Version{Name: "m1/v1", Dir: fstest.MapFS{
+		"index.html":    &fstest.MapFile{Data: []byte("report")},
+		"css/a b.css":   &fstest.MapFile{Data: []byte("css")},
+		"img/logo.png":  &fstest.MapFile{Data: []byte("png")},
+		"img/other.png": &fstest.MapFile{Data: []byte("png")},
+	}}
+	b.warmVersion(context.Background(), h, v, "/versions/m1/v1/")
+
+	// The landing page comes first, the walk stops after 3 files.
+	slices.Sort(paths)
+	want := []string{"/versions/m1/v1/", "/versions/m1/v1/css/a b.css", "/versions/m1/v1/img/logo.png"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("want %v, got %v", want, paths)
+	}
+}
@@ -3,6 +3,7 @@ module github.com/myhops/bbfsserver
 go 1.23.0
 
 require (
+	github.com/klauspost/compress v1.18.4
 	github.com/magefile/mage v1.15.0
 	github.com/maypok86/otter v1.2.2
 	github.com/myhops/bbfs v0.0.6
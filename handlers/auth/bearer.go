@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/myhops/bbfs/nulllog"
+)
+
+// TokenSource returns the tokens that are allowed.
+type TokenSource interface {
+	Tokens() ([]string, error)
+}
+
+// StaticTokens is a fixed list of tokens.
+type StaticTokens []string
+
+// Tokens returns the tokens.
+func (t StaticTokens) Tokens() ([]string, error) {
+	return t, nil
+}
+
+// FileTokens reads the tokens from a file with one token per line.
+// Empty lines and lines starting with # are ignored.
+// The file is read again when its modification time changes,
+// this allows you to rotate tokens without a restart.
+type FileTokens struct {
+	Path string
+
+	mtx     sync.Mutex
+	modTime time.Time
+	tokens  []string
+}
+
+// Tokens returns the tokens from the file.
+func (f *FileTokens) Tokens() ([]string, error) {
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading token file: %w", err)
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if fi.ModTime().Equal(f.modTime) {
+		return f.tokens, nil
+	}
+
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading token file: %w", err)
+	}
+	var tokens []string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		tokens = append(tokens, l)
+	}
+	f.tokens = tokens
+	f.modTime = fi.ModTime()
+	return f.tokens, nil
+}
+
+// validToken returns true if token is one of tokens.
+// The tokens are compared in constant time.
+func validToken(token string, tokens []string) bool {
+	th := sha256.Sum256([]byte(token))
+	var valid int
+	for _, t := range tokens {
+		h := sha256.Sum256([]byte(t))
+		valid |= subtle.ConstantTimeCompare(th[:], h[:])
+	}
+	return valid == 1
+}
+
+// Bearer returns a middleware that only passes requests with
+// an Authorization header that contains a token from one of the sources.
+// All requests are refused if the sources do not contain any tokens.
+func Bearer(logger *slog.Logger, sources ...TokenSource) func(next http.Handler) http.Handler {
+	if logger == nil {
+		logger = nulllog.Logger()
+	}
+	logger = logger.With(slog.String("handler", "auth.Bearer"))
+
+	unauthorized := func(w http.ResponseWriter) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || token == "" {
+				unauthorized(w)
+				return
+			}
+
+			var tokens []string
+			for _, s := range sources {
+				t, err := s.Tokens()
+				if err != nil {
+					logger.Error("error getting tokens", slog.String("error", err.Error()))
+					continue
+				}
+				tokens = append(tokens, t...)
+			}
+			if !validToken(token, tokens) {
+				logger.Warn("invalid token", slog.String("url", r.URL.String()))
+				unauthorized(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
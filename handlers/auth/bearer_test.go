@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBearer(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokenFile, []byte("# admin tokens\n\nfile-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := Bearer(nil, StaticTokens{"static-token"}, &FileTokens{Path: tokenFile})(next)
+
+	cases := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{name: "static", header: "Bearer static-token", want: http.StatusOK},
+		{name: "file", header: "Bearer file-token", want: http.StatusOK},
+		{name: "comment", header: "Bearer # admin tokens", want: http.StatusUnauthorized},
+		{name: "invalid", header: "Bearer other", want: http.StatusUnauthorized},
+		{name: "basic", header: "Basic static-token", want: http.StatusUnauthorized},
+		{name: "missing", want: http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			if c.header != "" {
+				r.Header.Set("Authorization", c.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != c.want {
+				t.Errorf("want %d, got %d", c.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestBearerNoTokens(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := Bearer(nil, StaticTokens{})(next)
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("want %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
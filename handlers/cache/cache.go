@@ -1,10 +1,19 @@
 package cache
 
 import (
-	"io"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
-	"net/http/httptest"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/maypok86/otter"
@@ -14,6 +23,19 @@ type entry struct {
 	body       []byte
 	header     http.Header
 	statusCode int
+	// labels are the labels of the request, for the statistics.
+	labels Labels
+}
+
+// size returns the number of bytes of the body and the headers.
+func (e *entry) size() int {
+	n := len(e.body)
+	for k, vs := range e.header {
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return n
 }
 
 func copyHeader(dst, src http.Header, filter func(k string, v string) bool) {
@@ -35,70 +57,532 @@ func writeEntry(w http.ResponseWriter, e *entry) {
 	w.Write(e.body)
 }
 
-// Middleware returns a middleware for the caching handler
-func Middleware(size int) func(next http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return Handler(next, size)
+// conditionalHeaders are removed from the requests to next,
+// so next always returns the full response.
+var conditionalHeaders = []string{
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+	"If-Range",
+}
+
+// upstreamRequest returns a GET for r with ctx, without the conditional headers and Range,
+// and with only the query parameters in allowlist.
+// The response is the full document for all clients that request the same key.
+func upstreamRequest(ctx context.Context, r *http.Request, allowlist []string) *http.Request {
+	nr := r.Clone(ctx)
+	nr.Method = http.MethodGet
+	for _, h := range conditionalHeaders {
+		nr.Header.Del(h)
 	}
+	nr.Header.Del("Range")
+	nr.URL.RawQuery = allowedQuery(r.URL.Query(), allowlist)
+	nr.RequestURI = nr.URL.RequestURI()
+	return nr
 }
 
-// CachingHandler returns a new handler that wraps next and caches each request
-func Handler(next http.Handler, size int) http.Handler {
-	logger := slog.Default().With(
-		slog.String("handler", "CachingHandler"),
-	)
-	c, err := otter.MustBuilder[string, *entry](10_000).
-		CollectStats().
-		Cost(func(key string, value *entry) uint32 {
-			return 1
-		}).
-		WithTTL(time.Hour).
-		Build()
+// allowedQuery returns the encoded query with only the parameters in allowlist, sorted by key.
+func allowedQuery(q url.Values, allowlist []string) string {
+	for k := range q {
+		if !slices.Contains(allowlist, k) {
+			delete(q, k)
+		}
+	}
+	return q.Encode()
+}
+
+// normalizePath returns the clean path of p, it keeps a trailing slash.
+func normalizePath(p string) string {
+	np := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// cacheKey returns the key of r for the handler with namespace.
+// HEAD uses the key of GET, the request to next is always a GET for the full document.
+func (c *Cache) cacheKey(namespace uint64, r *http.Request) string {
+	return fmt.Sprintf("%d %s %s", namespace, http.MethodGet, c.requestURL(r))
+}
+
+// requestURL returns the URL of r in the keys, the clean path and the allowed query.
+func (c *Cache) requestURL(r *http.Request) string {
+	u := url.URL{
+		Path:     normalizePath(r.URL.Path),
+		RawQuery: allowedQuery(r.URL.Query(), c.cfg.QueryAllowlist),
+	}
+	return u.String()
+}
+
+// diskKey returns the key of r in the disk tier, the persistent key and the URL below its prefix.
+func (c *Cache) diskKey(r *http.Request) (string, bool) {
+	p, ok := persistentFrom(r.Context())
+	if !ok {
+		return "", false
+	}
+	return p.key + " " + strings.TrimPrefix(c.requestURL(r), p.prefix), true
+}
+
+// keyURL returns the URL in key, the key of a variant ends with the encoding.
+func keyURL(key string) string {
+	fields := strings.SplitN(key, " ", 4)
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[2]
+}
+
+// serveRange writes the range of e that r requests.
+// http.ServeContent also answers the conditional requests and If-Range.
+func serveRange(w http.ResponseWriter, r *http.Request, e *entry) {
+	if e.statusCode != http.StatusOK {
+		writeEntryFor(w, r, e)
+		return
+	}
+	copyHeader(w.Header(), e.header, func(k, v string) bool { return k != "Content-Length" })
+	modtime, _ := http.ParseTime(e.header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(e.body))
+}
+
+// contentETag returns a strong ETag with a hash of body.
+func contentETag(body []byte) string {
+	h := sha256.Sum256(body)
+	return fmt.Sprintf(`"%x"`, h[:16])
+}
+
+// etagMatches returns true if etag is in the If-None-Match list,
+// the comparison is weak as required for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified returns true if the client has the current version of e.
+// If-Modified-Since is only used without If-None-Match.
+func notModified(r *http.Request, e *entry) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if e.statusCode < 200 || e.statusCode >= 300 {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := e.header.Get("ETag")
+		return etag != "" && etagMatches(inm, etag)
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
 	if err != nil {
-		panic(err)
+		return false
 	}
+	lm, err := http.ParseTime(e.header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lm.After(ims)
+}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger := logger.With(
-			slog.String("request.url", r.URL.String()),
-		)
-		// Check if the key is present.
-		if e, found := c.Get(r.URL.String()); found {
-			logger.Info("cache hit")
-			writeEntry(w, e)
-			return
+// writeEntryFor writes e or 304 Not Modified if the client of r has it already.
+func writeEntryFor(w http.ResponseWriter, r *http.Request, e *entry) {
+	if !notModified(r, e) {
+		writeEntry(w, e)
+		return
+	}
+	for _, h := range []string{"ETag", "Last-Modified", "Vary"} {
+		if v := e.header.Get(h); v != "" {
+			w.Header().Set(h, v)
 		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// Config configures a Cache.
+type Config struct {
+	// MaxBytes is the memory budget for the cached responses, body and headers.
+	MaxBytes int
+	// MaxEntryBytes is the size of the largest response that is cached,
+	// 0 means MaxBytes.
+	MaxEntryBytes int
+	// TTL is the time a response stays in the cache, 0 means until it is evicted.
+	TTL time.Duration
+	// QueryAllowlist are the query parameters that are part of the key and
+	// that are passed to next, the other parameters are removed.
+	QueryAllowlist []string
+	// Compress enables the compression of the responses for the clients that accept it.
+	Compress bool
+	// FetchTimeout limits the time to get the header of a response that is not cached,
+	// the body can take longer. 0 means no limit.
+	FetchTimeout time.Duration
+	// DiskDir is the directory of the disk tier, empty means no disk tier.
+	// Only the responses of requests with a persistent key are stored on disk.
+	DiskDir string
+	// DiskMaxBytes is the size of the files in the disk tier.
+	DiskMaxBytes int
+}
+
+// Cache holds the responses of the handlers that it wraps within a memory budget.
+type Cache struct {
+	logger  *slog.Logger
+	cfg     Config
+	entries otter.Cache[string, *entry]
+	// disk is the second tier, can be nil.
+	disk *disk
+	// stats counts the hits and misses and follows the entries.
+	stats *stats
 
-		// Record the response.
-		rr := httptest.NewRecorder()
-		next.ServeHTTP(rr, r)
-		// Create the entry
-		ne := &entry{
-			header:     http.Header{},
-			statusCode: rr.Result().StatusCode,
+	// lastNamespace separates the keys of the handlers.
+	lastNamespace atomic.Uint64
+
+	// inflight are the responses of next that are streaming by key.
+	inflightMtx sync.Mutex
+	inflight    map[string]*stream
+}
+
+// New returns a new cache.
+func New(cfg Config, logger *slog.Logger) (*Cache, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if cfg.MaxBytes < 1 {
+		return nil, fmt.Errorf("invalid cache size %d", cfg.MaxBytes)
+	}
+	if cfg.MaxEntryBytes < 1 || cfg.MaxEntryBytes > cfg.MaxBytes {
+		cfg.MaxEntryBytes = cfg.MaxBytes
+	}
+	st := newStats()
+	b := otter.MustBuilder[string, *entry](cfg.MaxBytes).
+		Cost(func(key string, value *entry) uint32 {
+			return uint32(len(key) + value.size())
+		}).
+		DeletionListener(func(key string, value *entry, cause otter.DeletionCause) {
+			st.deleted(value.labels, len(key)+value.size(), cause)
+		})
+	var c otter.Cache[string, *entry]
+	var err error
+	if cfg.TTL > 0 {
+		c, err = b.WithTTL(cfg.TTL).Build()
+	} else {
+		c, err = b.Build()
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger = logger.With(slog.String("handler", "CachingHandler"))
+	var d *disk
+	if cfg.DiskDir != "" {
+		if cfg.DiskMaxBytes < 1 {
+			return nil, fmt.Errorf("invalid disk cache size %d", cfg.DiskMaxBytes)
 		}
-		copyHeader(ne.header, rr.Result().Header, nil)
-		var err error
-		ne.body, err = io.ReadAll(rr.Result().Body)
+		d, err = newDisk(cfg.DiskDir, int64(cfg.DiskMaxBytes), logger)
 		if err != nil {
-			http.Error(w, "error reading body", http.StatusInternalServerError)
+			return nil, err
+		}
+	}
+	return &Cache{
+		logger:   logger,
+		cfg:      cfg,
+		entries:  c,
+		disk:     d,
+		stats:    st,
+		inflight: map[string]*stream{},
+	}, nil
+}
+
+// Middleware returns a middleware for the caching handler
+func (c *Cache) Middleware() func(next http.Handler) http.Handler {
+	return c.Handler
+}
+
+// handler caches the responses of next under its namespace.
+type handler struct {
+	c    *Cache
+	next http.Handler
+	// namespace separates the keys of the handlers.
+	namespace uint64
+	// released is set by Release, the responses are no longer cached.
+	released atomic.Bool
+}
+
+// Handler returns a new handler that wraps next and caches each request.
+// Each handler has its own keys, so a new handler for the same paths
+// does not serve the responses of the handler it replaces.
+// Release removes the responses of the replaced handler.
+func (c *Cache) Handler(next http.Handler) http.Handler {
+	return &handler{
+		c:         c,
+		next:      next,
+		namespace: c.lastNamespace.Add(1),
+	}
+}
+
+// Release removes the cached responses of h, a handler returned by Cache.Handler,
+// and stops caching the responses of h. Call it when h is replaced.
+// It returns the number of removed responses, 0 for other handlers.
+func Release(h http.Handler) int {
+	ch, ok := h.(*handler)
+	if !ok {
+		return 0
+	}
+	ch.released.Store(true)
+	return ch.c.purgeNamespace(ch.namespace)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := h.c
+	// Only GET and HEAD are cached.
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	key := c.cacheKey(h.namespace, r)
+	logger := c.logger.With(
+		slog.String("request.url", r.URL.String()),
+	)
+	ranged := r.Header.Get("Range") != ""
+	// Check if the key is present.
+	if e, found := c.entries.Get(key); found {
+		logger.Info("cache hit")
+		c.stats.hit(labelsFrom(r.Context()))
+		c.writeHit(w, r, key, e, ranged)
+		return
+	}
+	if e, found := c.getDisk(r); found {
+		logger.Info("disk cache hit")
+		c.stats.diskHit(e.labels)
+		c.prepare(e)
+		if !h.released.Load() {
+			c.set(key, e)
+		}
+		c.writeHit(w, r, key, e, ranged)
+		return
+	}
+
+	c.stats.miss(labelsFrom(r.Context()))
+	s, rd, joined := c.join(key, h, r)
+	if joined && ranged {
+		// Fill the cache with the full document in the background and
+		// let next answer the range.
+		s.leave(rd)
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if !joined {
+		// The start of a large response is gone, get it without the cache.
+		logger.Info("response too large to share")
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	defer s.leave(rd)
+	if err := c.writeStream(w, r, s, rd); err != nil {
+		if r.Context().Err() != nil {
+			logger.Info("client gone", slog.String("error", err.Error()))
 			return
 		}
+		logger.Error("error getting response", slog.String("error", err.Error()))
+	}
+}
 
-		// write response
-		writeEntry(w, ne)
+// writeHit writes the cached entry e for r, a range comes from the full document.
+func (c *Cache) writeHit(w http.ResponseWriter, r *http.Request, key string, e *entry, ranged bool) {
+	if ranged {
+		serveRange(w, r, e)
+		return
+	}
+	writeEntryFor(w, r, c.variant(key, e, r))
+}
+
+// join returns the stream of next for r and a reader for it.
+// Concurrent requests for the same key share one stream.
+// It returns false if the stream has dropped the start of the body.
+func (c *Cache) join(key string, h *handler, r *http.Request) (*stream, *reader, bool) {
+	c.inflightMtx.Lock()
+	defer c.inflightMtx.Unlock()
+	if s, found := c.inflight[key]; found {
+		c.logger.Debug("joining response in flight", slog.String("request.url", r.URL.String()))
+		rd, ok := s.join()
+		return s, rd, ok
+	}
+
+	// The request to next does not depend on the client that started it,
+	// it continues when that client disconnects and stops when there is
+	// no header after FetchTimeout.
+	ctx, cancel := context.WithCancelCause(context.WithoutCancel(r.Context()))
+	s := newStream(ctx, cancel, c.cfg.MaxEntryBytes)
+	if c.cfg.FetchTimeout > 0 {
+		s.timeoutHeader(c.cfg.FetchTimeout)
+	}
+	rd, _ := s.join()
+	c.inflight[key] = s
+	go c.fly(key, s, h, upstreamRequest(ctx, r, c.cfg.QueryAllowlist))
+	return s, rd, true
+}
+
+// fly streams the response of the next handler of h to the clients and
+// caches it when it is complete.
+func (c *Cache) fly(key string, s *stream, h *handler, r *http.Request) {
+	defer s.cancel(nil)
+	sw := &streamWriter{s: s, header: http.Header{}}
+	h.next.ServeHTTP(sw, r)
+	err := context.Cause(s.ctx)
+	// Cache the response before the clients finish, so their next requests are hits.
+	if err == nil && !h.released.Load() {
+		if e := c.store(key, s, sw.header, r); e != nil {
+			c.setDisk(r, e)
+		}
+	}
+	c.inflightMtx.Lock()
+	delete(c.inflight, key)
+	c.inflightMtx.Unlock()
+	s.finish(sw.header, err)
+}
+
+// getDisk returns the entry for r from the disk tier.
+func (c *Cache) getDisk(r *http.Request) (*entry, bool) {
+	key, ok := c.diskKey(r)
+	if c.disk == nil || !ok {
+		return nil, false
+	}
+	e, found := c.disk.get(key, c.diskRef(r))
+	if found {
+		e.labels = labelsFrom(r.Context())
+	}
+	return e, found
+}
 
-		logger.Info("cache miss",
-			slog.String("status", http.StatusText(ne.statusCode)),
-			slog.Int("body.len", len(ne.body)),
+// diskRef returns the request r for the purges of the disk tier.
+func (c *Cache) diskRef(r *http.Request) diskRef {
+	return diskRef{URL: c.requestURL(r), Version: labelsFrom(r.Context()).Version}
+}
+
+// setDisk stores e for r in the disk tier.
+func (c *Cache) setDisk(r *http.Request, e *entry) {
+	key, ok := c.diskKey(r)
+	if c.disk == nil || !ok {
+		return
+	}
+	if err := c.disk.set(key, c.diskRef(r), e); err != nil {
+		c.logger.Error("error storing response on disk",
+			slog.String("request.url", r.URL.String()),
+			slog.String("error", err.Error()),
 		)
+	}
+}
 
-		// Only cache 2xx results.
-		if ne.statusCode < 200 || ne.statusCode >= 300 {
-			return
+// store caches the response in s if possible and returns the cached entry.
+func (c *Cache) store(key string, s *stream, header http.Header, r *http.Request) *entry {
+	logger := c.logger.With(
+		slog.String("request.url", r.URL.String()),
+	)
+	e, complete := s.entry(header)
+	if complete {
+		e.labels = labelsFrom(r.Context())
+	}
+	if !complete {
+		logger.Info("response too large to cache")
+		return nil
+	}
+	logger.Info("cache miss",
+		slog.String("status", http.StatusText(e.statusCode)),
+		slog.Int("body.len", len(e.body)),
+	)
+	// Only cache 2xx results, and never a part of a document.
+	if e.statusCode < 200 || e.statusCode >= 300 || e.statusCode == http.StatusPartialContent {
+		return nil
+	}
+	// Add a strong validator if next did not.
+	if e.header.Get("ETag") == "" {
+		e.header.Set("ETag", contentETag(e.body))
+	}
+	c.prepare(e)
+	// Do not let large responses push out the others.
+	if size := len(key) + e.size(); size > c.cfg.MaxEntryBytes {
+		logger.Info("response too large to cache", slog.Int("size", size))
+		return nil
+	}
+	c.set(key, e)
+	return e
+}
+
+// set adds e to the memory tier.
+func (c *Cache) set(key string, e *entry) {
+	if c.entries.Set(key, e) {
+		c.stats.added(e.labels, len(key)+e.size())
+	}
+}
+
+// writeStream writes the response in s to the client of r.
+// The client stops waiting for the header when it disconnects or after FetchTimeout.
+func (c *Cache) writeStream(w http.ResponseWriter, r *http.Request, s *stream, rd *reader) error {
+	ctx := r.Context()
+	if c.cfg.FetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.FetchTimeout)
+		defer cancel()
+	}
+	head, err := s.waitHeader(ctx)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return err
 		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			http.Error(w, "timeout getting response", http.StatusGatewayTimeout)
+		} else {
+			http.Error(w, "error getting response", http.StatusInternalServerError)
+		}
+		return err
+	}
+	head, enc := c.streamEncoding(r, head)
+	if notModified(r, head) {
+		writeEntryFor(w, r, head)
+		return nil
+	}
+	copyHeader(w.Header(), head.header, nil)
+	w.WriteHeader(head.statusCode)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	rc := http.NewResponseController(w)
+	if enc == nil {
+		return s.writeBody(r.Context(), w, func() { rc.Flush() }, rd)
+	}
+	// Compress for this client, the cache compresses the complete response once.
+	ew, err := enc.newWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := s.writeBody(r.Context(), ew, func() {
+		ew.Flush()
+		rc.Flush()
+	}, rd); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// Middleware returns a middleware for the caching handler
+// with its own cache of size bytes.
+func Middleware(size int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return Handler(next, size)
+	}
+}
 
-		// Cache the result.
-		c.Set(r.URL.String(), ne)
-	})
+// Handler returns a new handler that wraps next and caches each request
+// in its own cache of size bytes.
+func Handler(next http.Handler, size int) http.Handler {
+	c, err := New(Config{
+		MaxBytes: size,
+		TTL:      time.Hour,
+	}, nil)
+	if err != nil {
+		panic(err)
+	}
+	return c.Handler(next)
 }
@@ -0,0 +1,309 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler returns a handler that writes body and counts the calls.
+func countingHandler(body string, calls *int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Write([]byte(body))
+	})
+}
+
+func get(h http.Handler, path string) string {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w.Body.String()
+}
+
+func TestCache(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20, MaxEntryBytes: 1 << 10}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	var small int
+	h := c.Handler(countingHandler("small", &small))
+	for range 3 {
+		if got := get(h, "/small"); got != "small" {
+			t.Errorf("want small, got %s", got)
+		}
+	}
+	if small != 1 {
+		t.Errorf("want 1 call, got %d", small)
+	}
+
+	var large int
+	h = c.Handler(countingHandler(strings.Repeat("x", 2<<10), &large))
+	get(h, "/large")
+	get(h, "/large")
+	if large != 2 {
+		t.Errorf("want large responses not cached, got %d calls", large)
+	}
+}
+
+func TestCacheHandlersHaveOwnKeys(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var calls int
+	old := c.Handler(countingHandler("old", &calls))
+	new := c.Handler(countingHandler("new", &calls))
+	if got := get(old, "/file.txt"); got != "old" {
+		t.Errorf("want old, got %s", got)
+	}
+	if got := get(new, "/file.txt"); got != "new" {
+		t.Errorf("want new, got %s", got)
+	}
+}
+
+func TestNewInvalidSize(t *testing.T) {
+	if _, err := New(Config{}, nil); err == nil {
+		t.Errorf("want error for size 0")
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	var upstreamConditions int
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+			upstreamConditions++
+		}
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte("report"))
+	}))
+	do := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/report.html", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// The first request is a miss with a condition, it streams without a content ETag.
+	if w := do("If-None-Match", `"other"`); w.Code != http.StatusOK || w.Body.String() != "report" {
+		t.Fatalf("want 200 with body, got %d %q", w.Code, w.Body.String())
+	}
+	// The cached response has one.
+	w := do("", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("want 200 with ETag, got %d %q", w.Code, etag)
+	}
+
+	w = do("If-None-Match", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("want 304 without body, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("want ETag %s, got %s", etag, got)
+	}
+
+	if w = do("If-Modified-Since", lastModified); w.Code != http.StatusNotModified {
+		t.Errorf("want 304, got %d", w.Code)
+	}
+	if w = do("If-Modified-Since", "Sun, 01 Jan 2006 15:04:05 GMT"); w.Code != http.StatusOK {
+		t.Errorf("want 200, got %d", w.Code)
+	}
+	if upstreamConditions != 0 {
+		t.Errorf("want conditions removed upstream, got %d", upstreamConditions)
+	}
+}
+
+func TestCoalesceMisses(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20, FetchTimeout: time.Second}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var calls atomic.Int32
+	release := make(chan struct{})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Write([]byte("report"))
+	}))
+
+	// The leader disconnects, the others still get the response.
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/report.html", nil).WithContext(ctx))
+		leader <- w.Code
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	bodies := make(chan string, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bodies <- get(h, "/report.html")
+		}()
+	}
+	cancel()
+	<-leader
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(bodies)
+
+	for body := range bodies {
+		if body != "report" {
+			t.Errorf("want report, got %q", body)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("want 1 upstream call, got %d", n)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20, FetchTimeout: 10 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	release := make(chan struct{})
+	defer close(release)
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("want %d, got %d", http.StatusGatewayTimeout, w.Code)
+	}
+}
+
+func TestFetchTimeoutLongBody(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20, FetchTimeout: 50 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	chunk := strings.Repeat("x", 1000)
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for range 10 {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// The body takes longer than FetchTimeout, only the header is limited.
+	resp, err := http.Get(srv.URL + "/large.html")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK || len(body) != 10*len(chunk) {
+		t.Errorf("want 200 with %d bytes, got %d with %d bytes", 10*len(chunk), resp.StatusCode, len(body))
+	}
+}
+
+func TestStream(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20, FetchTimeout: time.Second}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	release := make(chan struct{})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first "))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second"))
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/report.html")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	// The first bytes arrive before next is done.
+	buf := make([]byte, len("first "))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "first " {
+		t.Fatalf("want first, got %q %v", buf, err)
+	}
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil || string(rest) != "second" {
+		t.Fatalf("want second, got %q %v", rest, err)
+	}
+}
+
+func TestStreamLarge(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20, MaxEntryBytes: 1 << 10, FetchTimeout: time.Second}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	body := strings.Repeat("0123456789", 1<<10)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		for i := 0; i < len(body); i += 128 {
+			w.Write([]byte(body[i : i+128]))
+		}
+	}))
+
+	// The clients that joined before the cache copy was abandoned get the full body.
+	var wg sync.WaitGroup
+	bodies := make(chan string, 3)
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bodies <- get(h, "/large")
+		}()
+	}
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(bodies)
+	for got := range bodies {
+		if got != body {
+			t.Errorf("want %d bytes, got %d", len(body), len(got))
+		}
+	}
+
+	// The response was not cached.
+	if got := get(h, "/large"); got != body {
+		t.Errorf("want %d bytes, got %d", len(body), len(got))
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("want 2 upstream calls, got %d", n)
+	}
+}
@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// encodingWriter compresses the data written to it.
+type encodingWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// encoding is a content encoding that the cache applies.
+type encoding struct {
+	name      string
+	newWriter func(w io.Writer) (encodingWriter, error)
+}
+
+// encodings are the supported content encodings in the order of preference.
+var encodings = []encoding{
+	{name: "zstd", newWriter: func(w io.Writer) (encodingWriter, error) {
+		// One goroutine per response, the responses are compressed concurrently.
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}},
+	{name: "gzip", newWriter: func(w io.Writer) (encodingWriter, error) { return gzip.NewWriter(w), nil }},
+}
+
+// minCompressSize is the size of the smallest body that is compressed.
+const minCompressSize = 1 << 10
+
+// compressibleTypes are the prefixes of the media types that are compressed.
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// compressible returns true if the response e with a body of size bytes is compressed,
+// size -1 means unknown.
+func compressible(e *entry, size int) bool {
+	if e.statusCode < 200 || e.statusCode >= 300 || e.statusCode == http.StatusPartialContent {
+		return false
+	}
+	if e.header.Get("Content-Encoding") != "" {
+		return false
+	}
+	// Without a Content-Length, assume it is large enough.
+	if size < 0 {
+		size = minCompressSize
+		if cl := e.header.Get("Content-Length"); cl != "" {
+			size, _ = strconv.Atoi(cl)
+		}
+	}
+	if size < minCompressSize {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(e.header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(mt, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAcceptEncoding returns the quality of the encodings in an Accept-Encoding header.
+func parseAcceptEncoding(h string) map[string]float64 {
+	q := map[string]float64{}
+	for _, part := range strings.Split(h, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		if v, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				quality = f
+			}
+		}
+		q[name] = quality
+	}
+	return q
+}
+
+// acceptedEncoding returns the preferred encoding that the client of r accepts, or nil.
+func acceptedEncoding(r *http.Request) *encoding {
+	q := parseAcceptEncoding(r.Header.Get("Accept-Encoding"))
+	for i := range encodings {
+		enc := &encodings[i]
+		quality, found := q[enc.name]
+		if !found {
+			quality, found = q["*"]
+		}
+		if found && quality > 0 {
+			return enc
+		}
+	}
+	return nil
+}
+
+// addVary adds Accept-Encoding to the Vary header of h.
+func addVary(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		for _, token := range strings.Split(v, ",") {
+			token = strings.TrimSpace(token)
+			if token == "*" || strings.EqualFold(token, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
+
+// encodedHeader returns a copy of h for the variant with the encoding name.
+// The ETag gets the name of the encoding, the variants are different representations.
+func encodedHeader(h http.Header, name string) http.Header {
+	nh := h.Clone()
+	nh.Set("Content-Encoding", name)
+	nh.Del("Content-Length")
+	if etag := nh.Get("ETag"); strings.HasSuffix(etag, `"`) {
+		nh.Set("ETag", etag[:len(etag)-1]+"-"+name+`"`)
+	}
+	addVary(nh)
+	return nh
+}
+
+// encode returns the variant of e with enc.
+func encode(e *entry, enc *encoding) (*entry, error) {
+	var buf bytes.Buffer
+	w, err := enc.newWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(e.body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	h := encodedHeader(e.header, enc.name)
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	return &entry{
+		body:       buf.Bytes(),
+		header:     h,
+		statusCode: e.statusCode,
+		labels:     e.labels,
+	}, nil
+}
+
+// variant returns the entry to write for r, e or its encoded variant.
+// The variant is cached under key with the name of the encoding, so e is compressed once.
+func (c *Cache) variant(key string, e *entry, r *http.Request) *entry {
+	if !c.cfg.Compress || !compressible(e, len(e.body)) {
+		return e
+	}
+	enc := acceptedEncoding(r)
+	if enc == nil {
+		return e
+	}
+	vkey := key + " " + enc.name
+	if v, found := c.entries.Get(vkey); found {
+		return v
+	}
+	v, err := encode(e, enc)
+	if err != nil {
+		c.logger.Error("error encoding response",
+			slog.String("request.url", r.URL.String()),
+			slog.String("error", err.Error()),
+		)
+		return e
+	}
+	c.set(vkey, v)
+	return v
+}
+
+// prepare adds Vary to the header of e if the response is compressed for some clients.
+func (c *Cache) prepare(e *entry) {
+	if c.cfg.Compress && compressible(e, len(e.body)) {
+		addVary(e.header)
+	}
+}
+
+// streamEncoding returns the header to write for the streamed response head to the client of r
+// and the encoding to apply, if any.
+func (c *Cache) streamEncoding(r *http.Request, head *entry) (*entry, *encoding) {
+	if !c.cfg.Compress || !compressible(head, -1) {
+		return head, nil
+	}
+	h := head.header.Clone()
+	addVary(h)
+	enc := acceptedEncoding(r)
+	if enc != nil {
+		h = encodedHeader(h, enc.name)
+	}
+	return &entry{header: h, statusCode: head.statusCode}, enc
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompress(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20, Compress: true}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	body := strings.Repeat(`{"name":"report"}`, 200)
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/small.json" {
+			w.Header().Set("Content-Length", "2")
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	do := func(path, acceptEncoding, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	gunzip := func(w *httptest.ResponseRecorder) string {
+		if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+			t.Fatalf("want gzip, got %q", got)
+		}
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		b, _ := io.ReadAll(zr)
+		return string(b)
+	}
+
+	// The miss is streamed and compressed, the hit comes from the cached variant.
+	for range 2 {
+		w := do("/report.json", "br;q=1.0, gzip;q=0.8", "")
+		if got := gunzip(w); got != body {
+			t.Errorf("want body, got %d bytes", len(got))
+		}
+		if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("want Vary, got %q", got)
+		}
+	}
+
+	identity := do("/report.json", "", "")
+	if identity.Header().Get("Content-Encoding") != "" || identity.Body.String() != body {
+		t.Errorf("want identity")
+	}
+	if got := identity.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("want Vary, got %q", got)
+	}
+	if got := do("/report.json", "gzip;q=0", "").Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("want identity for q=0, got %q", got)
+	}
+
+	// The variant has its own ETag.
+	etag := do("/report.json", "gzip", "").Header().Get("ETag")
+	if etag == "" || etag == identity.Header().Get("ETag") {
+		t.Errorf("want variant ETag, got %q", etag)
+	}
+	if w := do("/report.json", "gzip", etag); w.Code != http.StatusNotModified {
+		t.Errorf("want %d, got %d", http.StatusNotModified, w.Code)
+	}
+
+	// zstd is preferred when the client accepts it.
+	for range 2 {
+		w := do("/report.json", "gzip, deflate, br, zstd", "")
+		if got := w.Header().Get("Content-Encoding"); got != "zstd" {
+			t.Fatalf("want zstd, got %q", got)
+		}
+		zr, err := zstd.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		b, _ := io.ReadAll(zr)
+		zr.Close()
+		if string(b) != body {
+			t.Errorf("want body, got %d bytes", len(b))
+		}
+	}
+
+	if got := do("/small.json", "gzip", "").Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("want small responses not compressed, got %q", got)
+	}
+}
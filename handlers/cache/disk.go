@@ -0,0 +1,363 @@
+package cache
+
+import (
+	"bytes"
+	"cmp"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+type persistentKey struct{}
+
+// persistent is the value of persistentKey.
+type persistent struct {
+	key    string
+	prefix string
+}
+
+// WithPersistentKey returns a copy of ctx that marks the response as immutable,
+// it is stored in the disk tier under key and the URL below prefix, with the clean path
+// and the allowed query as in the key of the memory tier.
+// Use a key that changes with the content, e.g. the commit.
+func WithPersistentKey(ctx context.Context, key, prefix string) context.Context {
+	return context.WithValue(ctx, persistentKey{}, persistent{key: key, prefix: prefix})
+}
+
+// persistentFrom returns the key and prefix set with WithPersistentKey.
+func persistentFrom(ctx context.Context) (persistent, bool) {
+	p, ok := ctx.Value(persistentKey{}).(persistent)
+	return p, ok && p.key != ""
+}
+
+// diskRef is a request that uses a file, files are shared by the versions of a commit.
+type diskRef struct {
+	URL     string
+	Version string
+}
+
+// diskMeta is the start of a file, it is read at startup for the purges.
+type diskMeta struct {
+	Key  string
+	Refs []diskRef
+}
+
+// diskEntry is the response in a file after diskMeta.
+type diskEntry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// diskFile is a file in the LRU list.
+type diskFile struct {
+	name string
+	size int64
+	// refs are the requests that used the file.
+	refs []diskRef
+}
+
+// disk is a cache tier of files in a directory within a byte limit.
+// The least recently used files are removed first.
+// The files in the directory are used again after a restart.
+type disk struct {
+	logger   *slog.Logger
+	dir      string
+	maxBytes int64
+
+	mtx   sync.Mutex
+	lru   *list.List
+	files map[string]*list.Element
+	size  int64
+}
+
+// newDisk returns a disk tier in dir with the files that are there already.
+func newDisk(dir string, maxBytes int64, logger *slog.Logger) (*disk, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating cache dir: %w", err)
+	}
+	d := &disk{
+		logger:   logger,
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		files:    map[string]*list.Element{},
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load adds the files in dir, the modification time is the last use.
+func (d *disk) load() error {
+	des, err := os.ReadDir(d.dir)
+	if err != nil {
+		return fmt.Errorf("error reading cache dir: %w", err)
+	}
+	type file struct {
+		diskFile
+		used int64
+	}
+	var found []file
+	for _, de := range des {
+		// Remove the files of writes that did not complete.
+		if de.Type().IsRegular() && filepath.Ext(de.Name()) == ".tmp" {
+			os.Remove(filepath.Join(d.dir, de.Name()))
+			continue
+		}
+		if !de.Type().IsRegular() || filepath.Ext(de.Name()) != ".entry" {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		meta, err := readMeta(filepath.Join(d.dir, de.Name()))
+		if err != nil || len(meta.Refs) == 0 {
+			d.logger.Warn("removing invalid disk cache file", slog.String("file", de.Name()))
+			os.Remove(filepath.Join(d.dir, de.Name()))
+			continue
+		}
+		found = append(found, file{
+			diskFile: diskFile{name: de.Name(), size: fi.Size(), refs: meta.Refs},
+			used:     fi.ModTime().UnixNano(),
+		})
+	}
+	slices.SortFunc(found, func(a, b file) int { return cmp.Compare(b.used, a.used) })
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, f := range found {
+		d.files[f.name] = d.lru.PushBack(&f.diskFile)
+		d.size += f.size
+	}
+	d.evict()
+	d.logger.Info("loaded disk cache", slog.Int("files", d.lru.Len()), slog.Int64("size", d.size))
+	return nil
+}
+
+// readMeta reads the diskMeta of the file p.
+func readMeta(p string) (*diskMeta, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var meta diskMeta
+	if err := gob.NewDecoder(f).Decode(&meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// fileName returns the name of the file for key.
+func fileName(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%x.entry", h)
+}
+
+// get returns the entry for key for the request ref.
+func (d *disk) get(key string, ref diskRef) (*entry, bool) {
+	name := fileName(key)
+	d.mtx.Lock()
+	el, found := d.files[name]
+	if found {
+		d.lru.MoveToFront(el)
+	}
+	d.mtx.Unlock()
+	if !found {
+		return nil, false
+	}
+
+	p := filepath.Join(d.dir, name)
+	f, err := os.Open(p)
+	if err != nil {
+		d.remove(name)
+		return nil, false
+	}
+	defer f.Close()
+	dec := gob.NewDecoder(f)
+	var meta diskMeta
+	var de diskEntry
+	if err := dec.Decode(&meta); err != nil || meta.Key != key || dec.Decode(&de) != nil {
+		d.logger.Warn("removing invalid disk cache file", slog.String("file", name))
+		d.remove(name)
+		return nil, false
+	}
+	// Keep the order for the next start.
+	if err := os.Chtimes(p, time.Time{}, time.Now()); err != nil {
+		d.logger.Debug("error touching disk cache file", slog.String("error", err.Error()))
+	}
+	if err := d.addRef(name, key, ref, &de); err != nil {
+		d.logger.Warn("error adding request to disk cache file", slog.String("error", err.Error()))
+	}
+	return &entry{
+		header:     de.Header,
+		statusCode: de.StatusCode,
+		body:       de.Body,
+	}, true
+}
+
+// set stores e for the request ref under key.
+// A file that exists already keeps its content and gets ref, the content of a key does not change.
+func (d *disk) set(key string, ref diskRef, e *entry) error {
+	de := &diskEntry{
+		StatusCode: e.statusCode,
+		Header:     e.header,
+		Body:       e.body,
+	}
+	b, err := encodeFile(&diskMeta{Key: key, Refs: []diskRef{ref}}, de)
+	if err != nil {
+		return err
+	}
+	size := int64(len(b))
+	if size > d.maxBytes {
+		return nil
+	}
+	name := fileName(key)
+	tmp, err := d.writeTemp(b)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if el, found := d.files[name]; found {
+		d.lru.MoveToFront(el)
+		return d.addRefLocked(el.Value.(*diskFile), key, ref, de)
+	}
+	if err := os.Rename(tmp, filepath.Join(d.dir, name)); err != nil {
+		return fmt.Errorf("error renaming file: %w", err)
+	}
+	d.files[name] = d.lru.PushFront(&diskFile{name: name, size: size, refs: []diskRef{ref}})
+	d.size += size
+	d.evict()
+	return nil
+}
+
+// addRef adds ref to the file name with key and de, if the file has not got it.
+func (d *disk) addRef(name, key string, ref diskRef, de *diskEntry) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	el, found := d.files[name]
+	if !found {
+		return nil
+	}
+	return d.addRefLocked(el.Value.(*diskFile), key, ref, de)
+}
+
+// addRefLocked adds ref to f and writes the file again, so the purges find it after a restart.
+// The caller must hold mtx.
+func (d *disk) addRefLocked(f *diskFile, key string, ref diskRef, de *diskEntry) error {
+	if slices.Contains(f.refs, ref) {
+		return nil
+	}
+	refs := append(slices.Clip(f.refs), ref)
+	b, err := encodeFile(&diskMeta{Key: key, Refs: refs}, de)
+	if err != nil {
+		return err
+	}
+	tmp, err := d.writeTemp(b)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Rename(tmp, filepath.Join(d.dir, f.name)); err != nil {
+		return fmt.Errorf("error renaming file: %w", err)
+	}
+	f.refs = refs
+	d.size += int64(len(b)) - f.size
+	f.size = int64(len(b))
+	d.evict()
+	return nil
+}
+
+// encodeFile returns the content of a file with meta and de.
+func encodeFile(meta *diskMeta, de *diskEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(meta); err != nil {
+		return nil, fmt.Errorf("error encoding entry: %w", err)
+	}
+	if err := enc.Encode(de); err != nil {
+		return nil, fmt.Errorf("error encoding entry: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeTemp writes b to a temporary file and returns its path.
+// The file is renamed afterwards, so a file is always complete.
+func (d *disk) writeTemp(b []byte) (string, error) {
+	tmp, err := os.CreateTemp(d.dir, "*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("error creating file: %w", err)
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("error writing file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("error writing file: %w", err)
+	}
+	return tmp.Name(), nil
+}
+
+// purge removes the files for which match returns true for one of the requests
+// and returns the number of files.
+func (d *disk) purge(match func(url, version string) bool) int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	n := 0
+	for el := d.lru.Front(); el != nil; {
+		next := el.Next()
+		if f := el.Value.(*diskFile); slices.ContainsFunc(f.refs, func(ref diskRef) bool {
+			return match(ref.URL, ref.Version)
+		}) {
+			d.removeElement(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// remove removes the file name.
+func (d *disk) remove(name string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if el, found := d.files[name]; found {
+		d.removeElement(el)
+	}
+}
+
+// evict removes the least recently used files until the size is within the limit.
+// The caller must hold mtx.
+func (d *disk) evict() {
+	for d.size > d.maxBytes && d.lru.Len() > 0 {
+		d.removeElement(d.lru.Back())
+	}
+}
+
+// removeElement removes the file of el.
+// The caller must hold mtx.
+func (d *disk) removeElement(el *list.Element) {
+	f := d.lru.Remove(el).(*diskFile)
+	delete(d.files, f.name)
+	d.size -= f.size
+	if err := os.Remove(filepath.Join(d.dir, f.name)); err != nil && !os.IsNotExist(err) {
+		d.logger.Warn("error removing disk cache file", slog.String("error", err.Error()))
+	}
+}
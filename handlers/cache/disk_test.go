@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// getWithKey gets path from h with the persistent key and the prefix /.
+func getWithKey(h http.Handler, path, key string) string {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	h.ServeHTTP(w, r.WithContext(WithPersistentKey(context.Background(), key, "/")))
+	return w.Body.String()
+}
+
+func TestDiskSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{MaxBytes: 1 << 20, DiskDir: dir, DiskMaxBytes: 1 << 20}
+
+	c, err := New(cfg, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var calls int
+	getWithKey(c.Handler(countingHandler("report", &calls)), "/report.html", "abc")
+	// Requests without a key are not stored on disk.
+	get(c.Handler(countingHandler("all", &calls)), "/all.html")
+
+	// A new cache with the same directory has the response.
+	c, err = New(cfg, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	h := c.Handler(countingHandler("other", &calls))
+	if got := getWithKey(h, "/report.html", "abc"); got != "report" {
+		t.Errorf("want report, got %s", got)
+	}
+	if got := get(h, "/all.html"); got != "other" {
+		t.Errorf("want other, got %s", got)
+	}
+	if calls != 3 {
+		t.Errorf("want 3 calls, got %d", calls)
+	}
+}
+
+func TestDiskKey(t *testing.T) {
+	cfg := Config{MaxBytes: 1 << 20, DiskDir: t.TempDir(), DiskMaxBytes: 1 << 20, QueryAllowlist: []string{"lang"}}
+	c, err := New(cfg, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var calls int
+	getWithKey(c.Handler(countingHandler("report", &calls)), "/docs/./report.html?lang=en&utm=x", "abc")
+
+	// The key of the disk tier has the clean path and the allowed query, as the memory tier.
+	c, err = New(cfg, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	h := c.Handler(countingHandler("other", &calls))
+	if got := getWithKey(h, "/docs//report.html?lang=en", "abc"); got != "report" {
+		t.Errorf("want report, got %s", got)
+	}
+	if got := getWithKey(h, "/docs/report.html?lang=nl", "abc"); got != "other" {
+		t.Errorf("want other for other allowed query, got %s", got)
+	}
+	if calls != 2 {
+		t.Errorf("want 2 calls, got %d", calls)
+	}
+}
+
+func TestDiskEviction(t *testing.T) {
+	dir := t.TempDir()
+	d, err := newDisk(dir, 3<<10, slog.Default())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	body := []byte(strings.Repeat("x", 1<<10))
+	for _, key := range []string{"a", "b"} {
+		if err := d.set(key, diskRef{URL: "/" + key}, &entry{statusCode: http.StatusOK, header: http.Header{}, body: body}); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	// a is used, so b is the least recently used.
+	if _, found := d.get("a", diskRef{URL: "/a"}); !found {
+		t.Fatalf("want a")
+	}
+	if err := d.set("c", diskRef{URL: "/c"}, &entry{statusCode: http.StatusOK, header: http.Header{}, body: body}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, found := d.get("b", diskRef{URL: "/b"}); found {
+		t.Errorf("want b evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, found := d.get(key, diskRef{URL: "/" + key}); !found {
+			t.Errorf("want %s", key)
+		}
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("want 2 files, got %d", len(files))
+	}
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20, QueryAllowlist: []string{"lang"}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var queries []string
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		w.Write([]byte("report"))
+	}))
+
+	for _, target := range []string{
+		"/report.html",
+		"/report.html?foo=bar",
+		"/a/../report.html?utm=1",
+		"/report.html?lang=nl",
+		"/report.html?foo=bar&lang=nl",
+	} {
+		get(h, target)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/report.html", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("want %d for HEAD, got %d", http.StatusOK, w.Code)
+	}
+	if want := []string{"", "lang=nl"}; strings.Join(queries, ",") != strings.Join(want, ",") {
+		t.Errorf("want upstream queries %q, got %q", want, queries)
+	}
+	// HEAD uses the full GET response.
+	if got := get(h, "/report.html"); got != "report" {
+		t.Errorf("want report, got %q", got)
+	}
+}
+
+func TestRange(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20, FetchTimeout: time.Second}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var calls atomic.Int32
+	fsys := fstest.MapFS{"report.txt": &fstest.MapFile{Data: []byte("0123456789")}}
+	fileServer := http.FileServerFS(fsys)
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		fileServer.ServeHTTP(w, r)
+	}))
+	getRange := func(rng string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/report.txt", nil)
+		r.Header.Set("Range", rng)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// The miss is answered by next, the cache gets the full document.
+	if w := getRange("bytes=0-3"); w.Code != http.StatusPartialContent || w.Body.String() != "0123" {
+		t.Fatalf("want 206 0123, got %d %q", w.Code, w.Body.String())
+	}
+	for i := 0; i < 100 && c.entries.Size() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if got := get(h, "/report.txt"); got != "0123456789" {
+		t.Errorf("want full document, got %q", got)
+	}
+	// The range comes from the cached full document.
+	if w := getRange("bytes=4-5"); w.Code != http.StatusPartialContent || w.Body.String() != "45" {
+		t.Errorf("want 206 45, got %d %q", w.Code, w.Body.String())
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("want 2 calls, got %d", n)
+	}
+}
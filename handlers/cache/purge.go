@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// urlMatcher returns a match func for the URL u.
+// Without a query, u matches the path with any query.
+func urlMatcher(u string) func(string) bool {
+	pu, err := url.Parse(u)
+	if err != nil || pu.RawQuery != "" {
+		return func(s string) bool { return s == u }
+	}
+	return func(s string) bool {
+		su, err := url.Parse(s)
+		return err == nil && su.Path == pu.Path
+	}
+}
+
+// purge removes the entries in both tiers for which match returns true,
+// it returns the number of removed entries.
+func (c *Cache) purge(match func(u string, labels Labels) bool) int {
+	n := 0
+	c.entries.DeleteByFunc(func(key string, e *entry) bool {
+		if match(keyURL(key), e.labels) {
+			n++
+			return true
+		}
+		return false
+	})
+	if c.disk != nil {
+		n += c.disk.purge(func(u, version string) bool {
+			return match(u, Labels{Version: version})
+		})
+	}
+	return n
+}
+
+// PurgeURL removes the responses for u, a URL without a query matches all queries.
+func (c *Cache) PurgeURL(u string) int {
+	m := urlMatcher(u)
+	return c.purge(func(s string, _ Labels) bool { return m(s) })
+}
+
+// PurgePrefix removes the responses for the URLs that start with prefix.
+func (c *Cache) PurgePrefix(prefix string) int {
+	return c.purge(func(s string, _ Labels) bool { return strings.HasPrefix(s, prefix) })
+}
+
+// PurgeVersion removes the responses for the version with name.
+func (c *Cache) PurgeVersion(name string) int {
+	return c.purge(func(_ string, labels Labels) bool { return labels.Version == name })
+}
+
+// PurgeAll removes all responses.
+func (c *Cache) PurgeAll() int {
+	return c.purge(func(string, Labels) bool { return true })
+}
+
+// purgeNamespace removes the responses of the handler with namespace from the memory tier,
+// the disk tier is keyed by content and is shared by the handlers.
+func (c *Cache) purgeNamespace(namespace uint64) int {
+	prefix := fmt.Sprintf("%d ", namespace)
+	n := 0
+	c.entries.DeleteByFunc(func(key string, _ *entry) bool {
+		if strings.HasPrefix(key, prefix) {
+			n++
+			return true
+		}
+		return false
+	})
+	return n
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPurge(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20, DiskDir: t.TempDir(), DiskMaxBytes: 1 << 20}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var calls int
+	h := c.Handler(countingHandler("report", &calls))
+	fill := func() {
+		for _, p := range []string{"/versions/v1/a.html", "/versions/v1/b.html?x=1", "/versions/v2/a.html"} {
+			r := httptest.NewRequest(http.MethodGet, p, nil)
+			ctx := WithLabels(context.Background(), Labels{Route: "/versions", Version: p[10:12]})
+			ctx = WithPersistentKey(ctx, p[10:12], "/versions/"+p[10:12]+"/")
+			h.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+		}
+	}
+
+	fill()
+	// Memory and disk.
+	if n := c.PurgeURL("/versions/v1/b.html"); n != 2 {
+		t.Errorf("want 2 purged for url, got %d", n)
+	}
+	if n := c.PurgePrefix("/versions/v1/"); n != 2 {
+		t.Errorf("want 2 purged for prefix, got %d", n)
+	}
+	if n := c.PurgeVersion("v2"); n != 2 {
+		t.Errorf("want 2 purged for version, got %d", n)
+	}
+	fill()
+	if n := c.PurgeAll(); n != 6 {
+		t.Errorf("want 6 purged, got %d", n)
+	}
+	if calls != 6 {
+		t.Errorf("want 6 calls, got %d", calls)
+	}
+}
+
+func TestPurgeSharedFile(t *testing.T) {
+	cfg := Config{MaxBytes: 1 << 20, DiskDir: t.TempDir(), DiskMaxBytes: 1 << 20}
+	c, err := New(cfg, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var calls int
+	h := c.Handler(countingHandler("report", &calls))
+	// The versions v1 and v2 have the same commit, so they share the file.
+	fetch := func(h http.Handler, version string) {
+		p := "/versions/" + version + "/"
+		ctx := WithLabels(context.Background(), Labels{Route: "/versions", Version: version})
+		ctx = WithPersistentKey(ctx, "abc", p)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p+"a.html", nil).WithContext(ctx))
+	}
+	fetch(h, "v1")
+	fetch(h, "v2")
+	if calls != 1 {
+		t.Fatalf("want 1 call, got %d", calls)
+	}
+
+	// The file has both versions after a restart.
+	c, err = New(cfg, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if n := c.PurgeVersion("v2"); n != 1 {
+		t.Errorf("want 1 purged for version, got %d", n)
+	}
+	fetch(c.Handler(countingHandler("report", &calls)), "v1")
+	if calls != 2 {
+		t.Errorf("want 2 calls, got %d", calls)
+	}
+	if n := c.PurgeURL("/versions/v1/a.html"); n != 2 {
+		t.Errorf("want 2 purged for url, got %d", n)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var oldCalls, newCalls int
+	old := c.Handler(countingHandler("old", &oldCalls))
+	h := c.Handler(countingHandler("new", &newCalls))
+	for _, p := range []string{"/all/a.html", "/all/b.html"} {
+		old.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+	}
+
+	// Only the responses of the released handler are removed.
+	if n := Release(old); n != 2 {
+		t.Errorf("want 2 released, got %d", n)
+	}
+	if n := Release(http.NotFoundHandler()); n != 0 {
+		t.Errorf("want 0 released for other handler, got %d", n)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/all/a.html", nil))
+	if newCalls != 2 {
+		t.Errorf("want 2 calls, got %d", newCalls)
+	}
+	// A released handler still serves, but does not cache.
+	old.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/all/a.html", nil))
+	if n := Release(old); n != 0 {
+		t.Errorf("want 0 cached for released handler, got %d", n)
+	}
+}
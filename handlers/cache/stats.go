@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"context"
+	"sync"
+
+	"github.com/maypok86/otter"
+)
+
+// Labels group the statistics of the requests.
+type Labels struct {
+	// Route is the class of the route, e.g. /versions.
+	Route string
+	// Version is the name of the version, if any.
+	Version string
+}
+
+type labelsKey struct{}
+
+// WithLabels returns a copy of ctx with the labels for the statistics of the request.
+func WithLabels(ctx context.Context, labels Labels) context.Context {
+	return context.WithValue(ctx, labelsKey{}, labels)
+}
+
+// labelsFrom returns the labels set with WithLabels.
+func labelsFrom(ctx context.Context) Labels {
+	labels, _ := ctx.Value(labelsKey{}).(Labels)
+	return labels
+}
+
+// Stats are the statistics of the cache or a part of it.
+type Stats struct {
+	Hits      int64   `json:"hits"`
+	DiskHits  int64   `json:"diskHits"`
+	Misses    int64   `json:"misses"`
+	HitRatio  float64 `json:"hitRatio"`
+	Evictions int64   `json:"evictions"`
+	Entries   int64   `json:"entries"`
+	Bytes     int64   `json:"bytes"`
+}
+
+// Report are the statistics of the cache per route class and per version.
+type Report struct {
+	Stats
+	Routes   map[string]Stats `json:"routes"`
+	Versions map[string]Stats `json:"versions"`
+}
+
+// stats counts the statistics by labels.
+type stats struct {
+	mtx      sync.Mutex
+	total    Stats
+	routes   map[string]*Stats
+	versions map[string]*Stats
+}
+
+func newStats() *stats {
+	return &stats{
+		routes:   map[string]*Stats{},
+		versions: map[string]*Stats{},
+	}
+}
+
+// update applies f to the total and to the stats of the labels.
+func (s *stats) update(labels Labels, f func(st *Stats)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	f(&s.total)
+	if labels.Route != "" {
+		f(statsFor(s.routes, labels.Route))
+	}
+	if labels.Version != "" {
+		f(statsFor(s.versions, labels.Version))
+	}
+}
+
+// statsFor returns the stats for key in m, it adds them if needed.
+func statsFor(m map[string]*Stats, key string) *Stats {
+	st, found := m[key]
+	if !found {
+		st = &Stats{}
+		m[key] = st
+	}
+	return st
+}
+
+func (s *stats) hit(labels Labels) {
+	s.update(labels, func(st *Stats) { st.Hits++ })
+}
+
+func (s *stats) diskHit(labels Labels) {
+	s.update(labels, func(st *Stats) {
+		st.Hits++
+		st.DiskHits++
+	})
+}
+
+func (s *stats) miss(labels Labels) {
+	s.update(labels, func(st *Stats) { st.Misses++ })
+}
+
+// added counts an entry of size bytes that was added.
+func (s *stats) added(labels Labels, size int) {
+	s.update(labels, func(st *Stats) {
+		st.Entries++
+		st.Bytes += int64(size)
+	})
+}
+
+// deleted counts an entry of size bytes that was deleted for cause.
+func (s *stats) deleted(labels Labels, size int, cause otter.DeletionCause) {
+	s.update(labels, func(st *Stats) {
+		st.Entries--
+		st.Bytes -= int64(size)
+		if cause == otter.Size || cause == otter.Expired {
+			st.Evictions++
+		}
+	})
+}
+
+// report returns a copy of the statistics.
+func (s *stats) report() Report {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r := Report{
+		Stats:    withRatio(s.total),
+		Routes:   make(map[string]Stats, len(s.routes)),
+		Versions: make(map[string]Stats, len(s.versions)),
+	}
+	for k, st := range s.routes {
+		r.Routes[k] = withRatio(*st)
+	}
+	for k, st := range s.versions {
+		r.Versions[k] = withRatio(*st)
+	}
+	return r
+}
+
+func withRatio(st Stats) Stats {
+	if n := st.Hits + st.Misses; n > 0 {
+		st.HitRatio = float64(st.Hits) / float64(n)
+	}
+	return st
+}
+
+// Stats returns the statistics of the cache.
+// The entries and bytes follow the evictions with a small delay.
+func (c *Cache) Stats() Report {
+	return c.stats.report()
+}
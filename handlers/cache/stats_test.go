@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	c, err := New(Config{MaxBytes: 1 << 20}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var calls int
+	h := c.Handler(countingHandler("report", &calls))
+	getLabeled := func(path string, labels Labels) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		h.ServeHTTP(httptest.NewRecorder(), r.WithContext(WithLabels(context.Background(), labels)))
+	}
+
+	v1 := Labels{Route: "/versions", Version: "v1"}
+	getLabeled("/versions/v1/a.html", v1)
+	getLabeled("/versions/v1/a.html", v1)
+	getLabeled("/versions/v1/a.html", v1)
+	getLabeled("/all/a.html", Labels{Route: "/all"})
+
+	r := c.Stats()
+	if r.Hits != 2 || r.Misses != 2 || r.Entries != 2 || r.Bytes == 0 {
+		t.Errorf("unexpected total: %+v", r.Stats)
+	}
+	if st := r.Versions["v1"]; st.Hits != 2 || st.Misses != 1 || st.Entries != 1 {
+		t.Errorf("unexpected stats for v1: %+v", st)
+	}
+	if st := r.Routes["/versions"]; st.HitRatio < 0.66 || st.HitRatio > 0.67 {
+		t.Errorf("want hit ratio 2/3, got %f", st.HitRatio)
+	}
+	if st := r.Routes["/all"]; st.Hits != 0 || st.Misses != 1 {
+		t.Errorf("unexpected stats for all: %+v", st)
+	}
+}
@@ -0,0 +1,263 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errNoReaders = errors.New("no clients left for the response")
+
+// stream is a response of next that is written to the clients while it arrives.
+// The clients that request the same key share the stream.
+// The body is kept for the cache until it exceeds the entry size limit,
+// after that only the part that a client still has to write is kept.
+type stream struct {
+	limit  int
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	mtx  sync.Mutex
+	cond *sync.Cond
+	// header and statusCode are set when next writes the header.
+	header     http.Header
+	statusCode int
+	// data is the body from offset base.
+	data []byte
+	base int
+	done bool
+	err  error
+	// abandoned is true when the body is too large for the cache.
+	abandoned bool
+	readers   map[*reader]struct{}
+}
+
+// reader is a client of a stream.
+type reader struct {
+	offset int
+}
+
+// newStream returns a stream that keeps up to limit bytes for the cache,
+// cancel stops next when there are no readers left.
+func newStream(ctx context.Context, cancel context.CancelCauseFunc, limit int) *stream {
+	s := &stream{
+		limit:   limit,
+		ctx:     ctx,
+		cancel:  cancel,
+		readers: map[*reader]struct{}{},
+	}
+	s.cond = sync.NewCond(&s.mtx)
+	// Wake up the waiting writer when ctx is done.
+	context.AfterFunc(ctx, s.broadcast)
+	return s
+}
+
+// timeoutHeader stops next when it has not written the header within d.
+// The body is not limited, a large file can take longer to send.
+func (s *stream) timeoutHeader(d time.Duration) {
+	t := time.AfterFunc(d, func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		if s.header == nil && !s.done {
+			s.cancel(context.DeadlineExceeded)
+		}
+	})
+	context.AfterFunc(s.ctx, func() { t.Stop() })
+}
+
+func (s *stream) broadcast() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.cond.Broadcast()
+}
+
+// join adds a reader, it returns false if the start of the body is gone.
+func (s *stream) join() (*reader, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.base > 0 {
+		return nil, false
+	}
+	rd := &reader{}
+	s.readers[rd] = struct{}{}
+	return rd, true
+}
+
+// leave removes the reader.
+// next is stopped when it is the last reader of a response that is not cached.
+func (s *stream) leave(rd *reader) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.readers, rd)
+	if s.abandoned && len(s.readers) == 0 {
+		s.cancel(errNoReaders)
+	}
+	s.trim()
+	s.cond.Broadcast()
+}
+
+// trim drops the data that all readers have written when the body is not cached.
+// The caller must hold mtx.
+func (s *stream) trim() {
+	if !s.abandoned {
+		return
+	}
+	low := s.base + len(s.data)
+	for rd := range s.readers {
+		low = min(low, rd.offset)
+	}
+	if low > s.base {
+		s.data = s.data[low-s.base:]
+		s.base = low
+	}
+}
+
+// setHeader sets the header once.
+func (s *stream) setHeader(header http.Header, statusCode int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.header != nil {
+		return
+	}
+	s.header = header.Clone()
+	s.statusCode = statusCode
+	s.cond.Broadcast()
+}
+
+// write adds p to the body.
+// When the body is not cached, it waits for the readers to keep up.
+func (s *stream) write(p []byte) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for s.abandoned && len(s.data) >= s.limit && len(s.readers) > 0 && s.ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if s.abandoned && len(s.readers) == 0 {
+		return 0, errNoReaders
+	}
+	s.data = append(s.data, p...)
+	if !s.abandoned && s.base+len(s.data) > s.limit {
+		s.abandoned = true
+		s.trim()
+	}
+	s.cond.Broadcast()
+	return len(p), nil
+}
+
+// finish marks the end of the body.
+func (s *stream) finish(header http.Header, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	// next returned without writing, that is 200 OK.
+	if s.header == nil {
+		s.header = header.Clone()
+		s.statusCode = http.StatusOK
+	}
+	s.done = true
+	s.err = err
+	s.cond.Broadcast()
+}
+
+// entry returns the response for the cache after next returned,
+// or false if it is too large.
+func (s *stream) entry(header http.Header) (*entry, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.abandoned {
+		return nil, false
+	}
+	if s.header == nil {
+		return &entry{header: header.Clone(), statusCode: http.StatusOK}, true
+	}
+	return &entry{
+		header:     s.header.Clone(),
+		statusCode: s.statusCode,
+		body:       s.data,
+	}, true
+}
+
+// waitHeader waits until the header is available or ctx is done.
+func (s *stream) waitHeader(ctx context.Context) (*entry, error) {
+	stop := context.AfterFunc(ctx, s.broadcast)
+	defer stop()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for s.header == nil && !s.done && ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	if s.header == nil {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, ctx.Err()
+	}
+	return &entry{header: s.header, statusCode: s.statusCode}, nil
+}
+
+// writeBody writes the body to w as it arrives, until it is complete or ctx is done.
+// flush is called after each write.
+func (s *stream) writeBody(ctx context.Context, w io.Writer, flush func(), rd *reader) error {
+	stop := context.AfterFunc(ctx, s.broadcast)
+	defer stop()
+
+	for {
+		s.mtx.Lock()
+		for rd.offset == s.base+len(s.data) && !s.done && ctx.Err() == nil {
+			s.cond.Wait()
+		}
+		if err := ctx.Err(); err != nil {
+			s.mtx.Unlock()
+			return err
+		}
+		// The written part of data does not change, so it can be used without the lock.
+		chunk := s.data[rd.offset-s.base:]
+		done, err := s.done, s.err
+		s.mtx.Unlock()
+
+		if len(chunk) == 0 {
+			if done {
+				return err
+			}
+			continue
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		flush()
+
+		s.mtx.Lock()
+		rd.offset += len(chunk)
+		s.trim()
+		s.cond.Broadcast()
+		s.mtx.Unlock()
+	}
+}
+
+// streamWriter is the http.ResponseWriter for next.
+type streamWriter struct {
+	s      *stream
+	header http.Header
+}
+
+func (sw *streamWriter) Header() http.Header {
+	return sw.header
+}
+
+func (sw *streamWriter) WriteHeader(statusCode int) {
+	sw.s.setHeader(sw.header, statusCode)
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.s.setHeader(sw.header, http.StatusOK)
+	return sw.s.write(p)
+}
+
+// Flush makes the http.FileServer and others see a flusher, the data is always available.
+func (sw *streamWriter) Flush() {}
@@ -0,0 +1,113 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/myhops/bbfs/nulllog"
+)
+
+// Event is a server-sent event.
+type Event struct {
+	Type string
+	Data any
+}
+
+// Broker sends the published events to all clients of its handler.
+type Broker struct {
+	logger *slog.Logger
+
+	// Heartbeat is the interval for comments that keep the connections open.
+	Heartbeat time.Duration
+
+	mtx         sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// New returns a new Broker.
+func New(logger *slog.Logger) *Broker {
+	if logger == nil {
+		logger = nulllog.Logger()
+	}
+	return &Broker{
+		logger:      logger.With(slog.String("handler", "events.Broker")),
+		Heartbeat:   30 * time.Second,
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+// Publish sends an event with type eventType and data as json to all clients.
+// Clients that are too slow miss the event.
+// Publish on a nil Broker does nothing.
+func (b *Broker) Publish(eventType string, data any) {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for c := range b.subscribers {
+		select {
+		case c <- Event{Type: eventType, Data: data}:
+		default:
+			b.logger.Warn("event dropped for slow client", slog.String("type", eventType))
+		}
+	}
+}
+
+func (b *Broker) subscribe() chan Event {
+	c := make(chan Event, 16)
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.subscribers[c] = struct{}{}
+	return c
+}
+
+func (b *Broker) unsubscribe(c chan Event) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	delete(b.subscribers, c)
+}
+
+// ServeHTTP streams the events to the client until the request is done.
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		b.logger.Error("streaming not supported", slog.String("error", err.Error()))
+		return
+	}
+
+	c := b.subscribe()
+	defer b.unsubscribe(c)
+
+	heartbeat := time.NewTicker(b.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case e := <-c:
+			data, err := json.Marshal(e.Data)
+			if err != nil {
+				b.logger.Error("error marshalling event", slog.String("error", err.Error()))
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
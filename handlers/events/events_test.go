@@ -0,0 +1,51 @@
+package events
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBroker(t *testing.T) {
+	b := New(nil)
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("error connecting: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("want text/event-stream, got %s", ct)
+	}
+
+	// Wait for the subscription.
+	for i := 0; ; i++ {
+		b.mtx.Lock()
+		n := len(b.subscribers)
+		b.mtx.Unlock()
+		if n == 1 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("client not subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.Publish("version-added", map[string]string{"name": "m1/v1"})
+
+	s := bufio.NewScanner(resp.Body)
+	var lines []string
+	for s.Scan() && s.Text() != "" {
+		lines = append(lines, s.Text())
+	}
+	want := "event: version-added\ndata: {\"name\":\"m1/v1\"}"
+	if got := strings.Join(lines, "\n"); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
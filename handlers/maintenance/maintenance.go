@@ -0,0 +1,42 @@
+package maintenance
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handler responds with the maintenance page and 503 Service Unavailable,
+// except for the requests with a path that starts with one of the passthrough prefixes.
+type Handler struct {
+	page        []byte
+	retryAfter  time.Duration
+	next        http.Handler
+	passthrough []string
+}
+
+// New returns a handler that serves page with a Retry-After of retryAfter
+// and passes the requests for the passthrough prefixes to next.
+func New(page []byte, retryAfter time.Duration, next http.Handler, passthrough ...string) *Handler {
+	return &Handler{
+		page:        page,
+		retryAfter:  retryAfter,
+		next:        next,
+		passthrough: passthrough,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, p := range h.passthrough {
+		if strings.HasPrefix(r.URL.Path, p) {
+			h.next.ServeHTTP(w, r)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(h.retryAfter.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(h.page)
+}
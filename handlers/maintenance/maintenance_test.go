@@ -0,0 +1,33 @@
+package maintenance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := New([]byte("maintenance"), 5*time.Minute, next, "/static/")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/versions/m1/v1/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("want %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "300" {
+		t.Errorf("want Retry-After 300, got %s", got)
+	}
+	if got := w.Body.String(); got != "maintenance" {
+		t.Errorf("want maintenance page, got %s", got)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/static/bootstrap.min.css", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("want static passed through, got %d", w.Code)
+	}
+}
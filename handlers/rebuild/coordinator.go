@@ -0,0 +1,159 @@
+package rebuild
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Run is a requested rebuild.
+type Run struct {
+	ID        uint64
+	Trigger   string
+	Requested time.Time
+}
+
+// Coordinator runs the rebuilds one at a time.
+// Triggers that arrive before a rebuild starts are coalesced into one run,
+// triggers that arrive during a rebuild result in exactly one follow-up run.
+type Coordinator struct {
+	// Rebuild performs the rebuild.
+	Rebuild func(ctx context.Context, run Run) error
+	// Debounce is the time without new triggers before a rebuild starts.
+	Debounce time.Duration
+	// Timeout cancels the context of a rebuild that takes longer, 0 means no timeout.
+	Timeout time.Duration
+
+	// OnTrigger is called when a new run is requested.
+	// It is called with the lock held and must not call Trigger.
+	OnTrigger func(run Run)
+	// OnJoin is called when trigger joins the pending run.
+	// It is called with the lock held and must not call Trigger.
+	OnJoin func(run Run, trigger string)
+	// OnStart is called before the rebuild starts.
+	OnStart func(run Run)
+	// OnSuccess is called when the rebuild succeeded.
+	OnSuccess func(run Run)
+	// OnError is called when the rebuild failed.
+	OnError func(run Run, err error)
+
+	once    sync.Once
+	wake    chan struct{}
+	mtx     sync.Mutex
+	lastID  uint64
+	pending *Run
+}
+
+func (c *Coordinator) init() {
+	c.once.Do(func() {
+		c.wake = make(chan struct{}, 1)
+	})
+}
+
+// Trigger requests a rebuild and returns the id of the run.
+// If a run is pending already, its id is returned.
+func (c *Coordinator) Trigger(trigger string) uint64 {
+	c.init()
+	c.mtx.Lock()
+	id := c.request(trigger)
+	c.mtx.Unlock()
+
+	// Wake the loop, a pending wake up is good enough.
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return id
+}
+
+// request returns the id of the pending run, it adds one if needed.
+// The caller must hold mtx.
+func (c *Coordinator) request(trigger string) uint64 {
+	if c.pending != nil {
+		if c.OnJoin != nil {
+			c.OnJoin(*c.pending, trigger)
+		}
+		return c.pending.ID
+	}
+	c.lastID++
+	c.pending = &Run{
+		ID:        c.lastID,
+		Trigger:   trigger,
+		Requested: time.Now(),
+	}
+	if c.OnTrigger != nil {
+		c.OnTrigger(*c.pending)
+	}
+	return c.lastID
+}
+
+// Run runs the rebuilds until ctx is done.
+func (c *Coordinator) Run(ctx context.Context) error {
+	c.init()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.wake:
+		}
+		if err := c.debounce(ctx); err != nil {
+			return err
+		}
+
+		c.mtx.Lock()
+		run := c.pending
+		c.pending = nil
+		c.mtx.Unlock()
+		if run == nil {
+			continue
+		}
+		c.run(ctx, *run)
+	}
+}
+
+// debounce waits until no triggers arrived for Debounce.
+func (c *Coordinator) debounce(ctx context.Context) error {
+	if c.Debounce <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(c.Debounce)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.wake:
+			timer.Reset(c.Debounce)
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+func (c *Coordinator) run(ctx context.Context, run Run) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	if c.OnStart != nil {
+		c.OnStart(run)
+	}
+	err := ErrHandlerNotSet
+	if c.Rebuild != nil {
+		err = c.Rebuild(ctx, run)
+	}
+	// Report a timeout even if Rebuild ignored the context.
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		if c.OnError != nil {
+			c.OnError(run, err)
+		}
+		return
+	}
+	if c.OnSuccess != nil {
+		c.OnSuccess(run)
+	}
+}
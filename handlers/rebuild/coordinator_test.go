@@ -0,0 +1,113 @@
+package rebuild
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoordinator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mtx sync.Mutex
+	var started []Run
+	var joined []string
+	release := make(chan struct{})
+	done := make(chan uint64, 10)
+	c := &Coordinator{
+		Debounce: 20 * time.Millisecond,
+		Rebuild: func(ctx context.Context, run Run) error {
+			<-release
+			return nil
+		},
+		OnStart: func(run Run) {
+			mtx.Lock()
+			started = append(started, run)
+			mtx.Unlock()
+		},
+		OnSuccess: func(run Run) {
+			done <- run.ID
+		},
+		OnJoin: func(run Run, trigger string) {
+			joined = append(joined, trigger)
+		},
+	}
+	go c.Run(ctx)
+
+	// A burst results in one run.
+	id1 := c.Trigger("timer")
+	if id := c.Trigger("webhook"); id != id1 {
+		t.Errorf("want coalesced id %d, got %d", id1, id)
+	}
+	if len(joined) != 1 || joined[0] != "webhook" {
+		t.Errorf("want webhook joined, got %v", joined)
+	}
+
+	// Wait until the first run started.
+	for i := 0; ; i++ {
+		mtx.Lock()
+		n := len(started)
+		mtx.Unlock()
+		if n == 1 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("run not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Triggers during the run result in exactly one follow-up.
+	id2 := c.Trigger("callback")
+	if id := c.Trigger("webhook"); id != id2 || id2 == id1 {
+		t.Errorf("want one follow-up, got %d and %d", id2, id)
+	}
+	close(release)
+
+	for _, want := range []uint64{id1, id2} {
+		select {
+		case got := <-done:
+			if got != want {
+				t.Errorf("want run %d, got %d", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("run %d did not finish", want)
+		}
+	}
+	select {
+	case id := <-done:
+		t.Errorf("unexpected run %d", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCoordinatorTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	c := &Coordinator{
+		Timeout: 10 * time.Millisecond,
+		Rebuild: func(ctx context.Context, run Run) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		OnError: func(run Run, err error) {
+			errs <- err
+		},
+	}
+	go c.Run(ctx)
+	c.Trigger("timer")
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("want deadline exceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("rebuild not cancelled")
+	}
+}
@@ -2,19 +2,29 @@ package rebuild
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/myhops/bbfsserver/handlers/settable"
 )
 
 var ErrHandlerNotSet = fmt.Errorf("handler not set")
 
+// ErrValidationFailed is returned when Validate rejects the new handler.
+var ErrValidationFailed = errors.New("validation failed")
+
 type RebuildHandler struct {
 	// BuildHandler builds a new handler.
 	BuildHandler func(context.Context) (http.Handler, error)
+	// Validate checks the new handler before it is set, optional.
+	// The old handler is kept when it returns an error.
+	Validate func(context.Context, http.Handler) error
 
 	handler settable.Settable
+	ready   atomic.Bool
 }
 
 // NewNoRebuild creates a new RebuildHandler, but does not build the handler.
@@ -26,6 +36,14 @@ func NewNoRebuild(bh func(context.Context) (http.Handler, error)) *RebuildHandle
 	return h
 }
 
+// NewWithFallback creates a new RebuildHandler that serves fallback
+// until the first successful rebuild, it does not build the handler.
+func NewWithFallback(fallback http.Handler, bh func(context.Context) (http.Handler, error)) *RebuildHandler {
+	h := NewNoRebuild(bh)
+	h.handler.Set(fallback)
+	return h
+}
+
 // New creates and builds a new handler.
 // The context is used during the rebuild.
 func New(ctx context.Context, bh func(context.Context) (http.Handler, error)) (*RebuildHandler, error) {
@@ -33,7 +51,7 @@ func New(ctx context.Context, bh func(context.Context) (http.Handler, error)) (*
 	if err := h.rebuild(ctx); err != nil {
 		return nil, err
 	}
-	return h, nil	
+	return h, nil
 }
 
 func (h *RebuildHandler) rebuild(ctx context.Context) error {
@@ -44,10 +62,26 @@ func (h *RebuildHandler) rebuild(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	if h.Validate != nil {
+		if err := h.Validate(ctx, nh); err != nil {
+			return fmt.Errorf("%w: %w", ErrValidationFailed, err)
+		}
+	}
 	h.handler.Set(nh)
+	h.ready.Store(true)
 	return nil
 }
 
+// SetLogger sets the logger for the handler swaps.
+func (h *RebuildHandler) SetLogger(logger *slog.Logger) {
+	h.handler.SetLogger(logger)
+}
+
+// Ready returns true if a handler has been built.
+func (h *RebuildHandler) Ready() bool {
+	return h.ready.Load()
+}
+
 // Rebuild rebuilds and sets the handler.
 func (h *RebuildHandler) Rebuild(ctx context.Context) error {
 	return h.rebuild(ctx)
@@ -56,4 +90,4 @@ func (h *RebuildHandler) Rebuild(ctx context.Context) error {
 // ServeHTTP passes the request to the handler that BuildHandler creates.
 func (h *RebuildHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.handler.ServeHTTP(w, r)
-}
\ No newline at end of file
+}
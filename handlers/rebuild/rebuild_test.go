@@ -0,0 +1,85 @@
+package rebuild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewWithFallback(t *testing.T) {
+	status := func(h http.Handler) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+
+	fail := true
+	built := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	h := NewWithFallback(fallback, func(context.Context) (http.Handler, error) {
+		if fail {
+			return nil, errors.New("bitbucket down")
+		}
+		return built, nil
+	})
+
+	if err := h.Rebuild(context.Background()); err == nil {
+		t.Errorf("want error")
+	}
+	if h.Ready() {
+		t.Errorf("want not ready")
+	}
+	if got := status(h); got != http.StatusServiceUnavailable {
+		t.Errorf("want fallback, got %d", got)
+	}
+
+	fail = false
+	if err := h.Rebuild(context.Background()); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if !h.Ready() {
+		t.Errorf("want ready")
+	}
+	if got := status(h); got != http.StatusOK {
+		t.Errorf("want built handler, got %d", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	status := func(h http.Handler) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+
+	code := http.StatusOK
+	h := NewNoRebuild(func(context.Context) (http.Handler, error) {
+		c := code
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c)
+		}), nil
+	})
+	h.Validate = func(_ context.Context, nh http.Handler) error {
+		if got := status(nh); got >= 500 {
+			return fmt.Errorf("status %d", got)
+		}
+		return nil
+	}
+
+	if err := h.Rebuild(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	code = http.StatusInternalServerError
+	if err := h.Rebuild(context.Background()); !errors.Is(err, ErrValidationFailed) {
+		t.Errorf("want validation failed, got %v", err)
+	}
+	if got := status(h); got != http.StatusOK {
+		t.Errorf("want old handler, got %d", got)
+	}
+}
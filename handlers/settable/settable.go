@@ -1,28 +1,114 @@
 package settable
 
 import (
+	"log/slog"
 	"net/http"
-	"sync"
+	"sync/atomic"
 )
 
-// Settable allows you to wrap a handler and change it
+// generation is a handler together with the requests it is serving.
+type generation struct {
+	id      uint64
+	next    http.Handler
+	active  atomic.Int64
+	retired atomic.Bool
+	drained atomic.Bool
+}
+
+// Settable allows you to wrap a handler and change it.
+// Set does not wait for the requests on the old handler,
+// they finish on the handler they started with.
 type Settable struct {
-	rwMtx sync.RWMutex
-	next  http.Handler
+	current atomic.Pointer[generation]
+	lastID  atomic.Uint64
+	logger  atomic.Pointer[slog.Logger]
 }
 
 // ServeHTTP makes Settable an http.Handler
 func (h *Settable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.rwMtx.RLock()
-	defer h.rwMtx.RUnlock()
-	h.next.ServeHTTP(w, r)
+	g := h.acquire()
+	if g == nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer h.release(g)
+	if g.next == nil {
+		http.NotFound(w, r)
+		return
+	}
+	g.next.ServeHTTP(w, r)
+}
+
+// acquire starts a request on the current generation.
+// A Set between loading and counting may have drained the generation already,
+// so the request moves to the new generation.
+func (h *Settable) acquire() *generation {
+	for {
+		g := h.current.Load()
+		if g == nil {
+			return nil
+		}
+		g.active.Add(1)
+		if h.current.Load() == g {
+			return g
+		}
+		h.release(g)
+	}
+}
+
+// release ends a request on g.
+func (h *Settable) release(g *generation) {
+	if g.active.Add(-1) == 0 && g.retired.Load() {
+		h.drain(g)
+	}
+}
+
+// drain logs that the last request on the retired generation g completed.
+func (h *Settable) drain(g *generation) {
+	if !g.drained.CompareAndSwap(false, true) {
+		return
+	}
+	if logger := h.logger.Load(); logger != nil {
+		logger.Info("handler generation drained", slog.Uint64("generation", g.id))
+	}
 }
 
 // Set sets a new handler, this replaces the old wrapped handler
 func (h *Settable) Set(next http.Handler) {
-	h.rwMtx.Lock()
-	defer h.rwMtx.Unlock()
-	h.next = next
+	g := &generation{
+		id:   h.lastID.Add(1),
+		next: next,
+	}
+	old := h.current.Swap(g)
+	if logger := h.logger.Load(); logger != nil {
+		logger.Debug("handler set", slog.Uint64("generation", g.id))
+	}
+	if old == nil {
+		return
+	}
+	old.retired.Store(true)
+	if old.active.Load() == 0 {
+		h.drain(old)
+	}
+}
+
+// Get returns the wrapped handler
+func (h *Settable) Get() http.Handler {
+	g := h.current.Load()
+	if g == nil {
+		return nil
+	}
+	return g.next
+}
+
+// Generation returns the number of times Set was called.
+func (h *Settable) Generation() uint64 {
+	return h.lastID.Load()
+}
+
+// SetLogger sets the logger for the handler swaps, by default nothing is logged.
+func (h *Settable) SetLogger(logger *slog.Logger) {
+	h.logger.Store(logger)
 }
 
 // New returns a new settable handler that wraps next
@@ -30,7 +116,7 @@ func New(next http.Handler) *Settable {
 	if next == nil {
 		next = http.NotFoundHandler()
 	}
-	return &Settable{
-		next: next,
-	}
+	h := &Settable{}
+	h.Set(next)
+	return h
 }
@@ -0,0 +1,62 @@
+package settable
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSetDoesNotBlock(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "old")
+	})
+	h := New(slow)
+	old := h.current.Load()
+
+	done := make(chan string)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		done <- w.Body.String()
+	}()
+	<-started
+
+	set := make(chan struct{})
+	go func() {
+		h.Set(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "new")
+		}))
+		close(set)
+	}()
+	select {
+	case <-set:
+	case <-time.After(time.Second):
+		t.Fatalf("Set blocked on the request in flight")
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := w.Body.String(); got != "new" {
+		t.Errorf("want new, got %s", got)
+	}
+	if h.Generation() != 2 {
+		t.Errorf("want generation 2, got %d", h.Generation())
+	}
+	if old.drained.Load() {
+		t.Errorf("want old generation active")
+	}
+
+	close(release)
+	if got := <-done; got != "old" {
+		t.Errorf("want old, got %s", got)
+	}
+	if !old.drained.Load() {
+		t.Errorf("want old generation drained")
+	}
+}
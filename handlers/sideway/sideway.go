@@ -3,6 +3,8 @@ package sideway
 import (
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/myhops/bbfs/nulllog"
 )
@@ -21,7 +23,7 @@ func New(next http.Handler, logger *slog.Logger) *Handler {
 	return &Handler{
 		handler: http.NewServeMux(),
 		next:    next,
-		logger: logger,
+		logger:  logger,
 	}
 }
 
@@ -30,17 +32,39 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	mh, pattern := h.handler.Handler(r)
 	if pattern != "" {
 		logger.Info("calling sideway", slog.String("pattern", pattern))
-		mh.ServeHTTP(w,r)
+		mh.ServeHTTP(w, r)
 		return
 	}
 	logger.Info("calling next")
-	h.next.ServeHTTP(w,r)
+	h.next.ServeHTTP(w, r)
 }
 
-func (h *Handler) Handle(pattern string, handler http.Handler) {
+// Handle registers handler for pattern.
+// The middlewares wrap handler, the first middleware is the outermost.
+func (h *Handler) Handle(pattern string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
 	h.handler.Handle(pattern, handler)
 }
 
-func (h *Handler) HandleFunc(pattern string, handler http.HandlerFunc) {
-	h.handler.HandleFunc(pattern, handler)
+// HandleFunc registers handler for pattern, see Handle.
+func (h *Handler) HandleFunc(pattern string, handler http.HandlerFunc, middlewares ...func(http.Handler) http.Handler) {
+	h.Handle(pattern, handler, middlewares...)
+}
+
+// AllowMethods returns a middleware that refuses requests with other methods
+// with 405 Method Not Allowed.
+func AllowMethods(methods ...string) func(http.Handler) http.Handler {
+	allow := strings.Join(methods, ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !slices.Contains(methods, r.Method) {
+				w.Header().Set("Allow", allow)
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
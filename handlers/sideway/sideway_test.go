@@ -48,3 +48,38 @@ func TestSideway(t *testing.T) {
 	}
 
 }
+
+func TestSidewayMiddleware(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Order")))
+	})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	mw := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.Header.Add("X-Order", name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	srv := New(next, slog.Default())
+	srv.HandleFunc("/api/controllers", handler, AllowMethods(http.MethodPost), mw("first"), mw("second"))
+
+	r := httptest.NewRequest(http.MethodPost, "/api/controllers", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	if got := w.Body.String(); got != "first" {
+		t.Errorf("want first middleware to run first, got %s", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/controllers", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	if got := w.Header().Get("Allow"); got != http.MethodPost {
+		t.Errorf("want Allow %s, got %s", http.MethodPost, got)
+	}
+}
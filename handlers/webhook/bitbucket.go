@@ -0,0 +1,172 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/myhops/bbfs/nulllog"
+)
+
+const (
+	// EventRefsChanged is the event key for pushes to a repository.
+	EventRefsChanged = "repo:refs_changed"
+	// EventPing is the event key for the test button in the webhook settings.
+	EventPing = "diagnostics:ping"
+
+	headerEventKey  = "X-Event-Key"
+	headerSignature = "X-Hub-Signature"
+
+	maxBodySize = 1 << 20
+)
+
+// Ref is a ref that is changed by a push.
+type Ref struct {
+	ID        string `json:"id"`
+	DisplayID string `json:"displayId"`
+	// Type is TAG or BRANCH.
+	Type string `json:"type"`
+}
+
+// Change is a single ref change in a push.
+type Change struct {
+	Ref      Ref    `json:"ref"`
+	RefID    string `json:"refId"`
+	FromHash string `json:"fromHash"`
+	ToHash   string `json:"toHash"`
+	// Type is ADD, UPDATE or DELETE.
+	Type string `json:"type"`
+}
+
+// Event is the payload of a repo:refs_changed event.
+type Event struct {
+	EventKey   string `json:"eventKey"`
+	Repository struct {
+		Slug    string `json:"slug"`
+		Project struct {
+			Key string `json:"key"`
+		} `json:"project"`
+	} `json:"repository"`
+	Changes []Change `json:"changes"`
+}
+
+// Config contains the configuration for the Bitbucket webhook handler.
+type Config struct {
+	// Secret is the secret that Bitbucket uses to sign the events.
+	Secret string
+	// ProjectKey and RepositorySlug identify the repository that is served,
+	// events for other repositories are ignored.
+	ProjectKey     string
+	RepositorySlug string
+	// Accept returns true if a change of the ref should trigger.
+	// All refs are accepted if Accept is nil.
+	Accept func(ref Ref) bool
+	// Trigger is called for every event that contains an accepted change.
+	Trigger func()
+}
+
+// Handler receives Bitbucket Server webhook events.
+type Handler struct {
+	cfg    Config
+	logger *slog.Logger
+}
+
+// New returns a new webhook handler.
+func New(cfg Config, logger *slog.Logger) *Handler {
+	if logger == nil {
+		logger = nulllog.Logger()
+	}
+	if cfg.Accept == nil {
+		cfg.Accept = func(Ref) bool { return true }
+	}
+	return &Handler{
+		cfg:    cfg,
+		logger: logger,
+	}
+}
+
+// validSignature returns true if signature is the hmac of body.
+// The signature has the format sha256=<hex encoded hmac>.
+func validSignature(secret string, body []byte, signature string) bool {
+	sig, found := strings.CutPrefix(signature, "sha256=")
+	if !found {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// ServeHTTP makes Handler an http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.With(
+		slog.String("method", "webhook.ServeHTTP"),
+		slog.String("event", r.Header.Get(headerEventKey)),
+	)
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "error reading body", http.StatusBadRequest)
+		return
+	}
+	if !validSignature(h.cfg.Secret, body, r.Header.Get(headerSignature)) {
+		logger.Warn("invalid signature")
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Header.Get(headerEventKey) {
+	case EventPing:
+		w.WriteHeader(http.StatusOK)
+		return
+	case EventRefsChanged:
+	default:
+		logger.Info("event ignored")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		http.Error(w, "error parsing event", http.StatusBadRequest)
+		return
+	}
+	if !h.accepted(&event, logger) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.cfg.Trigger()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// accepted returns true if the event concerns the repository and contains an accepted change.
+func (h *Handler) accepted(event *Event, logger *slog.Logger) bool {
+	if !strings.EqualFold(event.Repository.Project.Key, h.cfg.ProjectKey) ||
+		!strings.EqualFold(event.Repository.Slug, h.cfg.RepositorySlug) {
+		logger.Info("event for other repository ignored",
+			slog.String("projectKey", event.Repository.Project.Key),
+			slog.String("repositorySlug", event.Repository.Slug),
+		)
+		return false
+	}
+	for _, c := range event.Changes {
+		if h.cfg.Accept(c.Ref) {
+			logger.Info("change accepted",
+				slog.String("ref", c.Ref.ID),
+				slog.String("type", c.Type),
+			)
+			return true
+		}
+	}
+	logger.Info("no accepted changes")
+	return false
+}
@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testEvent = `{
+	"eventKey": "repo:refs_changed",
+	"repository": {"slug": "reports", "project": {"key": "PRJ"}},
+	"changes": [
+		{"ref": {"id": "refs/tags/m1/v1", "displayId": "m1/v1", "type": "TAG"}, "type": "ADD"}
+	]
+}`
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestBitbucket(t *testing.T) {
+	cases := []struct {
+		name      string
+		secret    string
+		project   string
+		accept    func(Ref) bool
+		want      int
+		triggered bool
+	}{
+		{
+			name:      "accepted",
+			secret:    "secret",
+			project:   "PRJ",
+			want:      http.StatusAccepted,
+			triggered: true,
+		},
+		{
+			name:    "bad signature",
+			secret:  "other",
+			project: "PRJ",
+			want:    http.StatusUnauthorized,
+		},
+		{
+			name:    "other repository",
+			secret:  "secret",
+			project: "OTHER",
+			want:    http.StatusNoContent,
+		},
+		{
+			name:    "filtered",
+			secret:  "secret",
+			project: "PRJ",
+			accept:  func(r Ref) bool { return r.Type == "BRANCH" },
+			want:    http.StatusNoContent,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var triggered bool
+			h := New(Config{
+				Secret:         "secret",
+				ProjectKey:     c.project,
+				RepositorySlug: "reports",
+				Accept:         c.accept,
+				Trigger:        func() { triggered = true },
+			}, nil)
+
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(testEvent))
+			r.Header.Set(headerEventKey, EventRefsChanged)
+			r.Header.Set(headerSignature, sign(c.secret, testEvent))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != c.want {
+				t.Errorf("want status %d, got %d", c.want, w.Code)
+			}
+			if triggered != c.triggered {
+				t.Errorf("want triggered %v, got %v", c.triggered, triggered)
+			}
+		})
+	}
+}
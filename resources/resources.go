@@ -5,5 +5,8 @@ import "embed"
 //go:embed web/index.html
 var IndexHtmlTemplate string
 
+//go:embed web/maintenance.html
+var MaintenanceHtml []byte
+
 //go:embed web
 var StaticHtmlFS embed.FS
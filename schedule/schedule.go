@@ -0,0 +1,180 @@
+// Package schedule computes when to poll, based on cron expressions,
+// a fixed interval and quiet hours.
+package schedule
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// Entry is a cron expression with a random delay of up to Jitter.
+type Entry struct {
+	Cron   *Cron
+	Jitter time.Duration
+}
+
+// ParseEntries parses entries separated by semicolons.
+// An entry is a cron expression optionally followed by a jitter duration,
+// e.g. "* 8-17 * * 1-5 10s; 0 * * * * 2m".
+func ParseEntries(spec string) ([]Entry, error) {
+	var entries []Entry
+	for _, part := range strings.Split(spec, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		var jitter time.Duration
+		if len(fields) == 6 {
+			var err error
+			jitter, err = time.ParseDuration(fields[5])
+			if err != nil {
+				return nil, fmt.Errorf("invalid jitter in %q: %w", part, err)
+			}
+			fields = fields[:5]
+		}
+		c, err := ParseCron(strings.Join(fields, " "))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{
+			Cron:   c,
+			Jitter: jitter,
+		})
+	}
+	return entries, nil
+}
+
+// Window is a daily period between Start and End,
+// both are durations since midnight.
+// The window passes midnight if End is before Start.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// parseClock parses hh:mm.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want hh:mm", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParseWindows parses windows separated by commas, e.g. "22:00-06:00,12:00-13:00".
+func ParseWindows(spec string) ([]Window, error) {
+	var windows []Window
+	for _, part := range strings.Split(spec, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		start, end, found := strings.Cut(part, "-")
+		if !found {
+			return nil, fmt.Errorf("invalid window %q, want hh:mm-hh:mm", part)
+		}
+		w := Window{}
+		var err error
+		if w.Start, err = parseClock(start); err != nil {
+			return nil, err
+		}
+		if w.End, err = parseClock(end); err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// midnight returns the start of the day of t.
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// end returns the end of the window if t is in the window.
+func (w Window) end(t time.Time) (time.Time, bool) {
+	day := midnight(t)
+	since := t.Sub(day)
+	switch {
+	case w.Start <= w.End:
+		if since >= w.Start && since < w.End {
+			return day.Add(w.End), true
+		}
+	case since >= w.Start:
+		// In the part before midnight.
+		return midnight(day.AddDate(0, 0, 1)).Add(w.End), true
+	case since < w.End:
+		// In the part after midnight.
+		return day.Add(w.End), true
+	}
+	return time.Time{}, false
+}
+
+// Schedule returns the times to poll.
+// It uses the entries if present and the interval otherwise.
+// No polls are scheduled during the quiet windows.
+type Schedule struct {
+	Entries  []Entry
+	Interval time.Duration
+	Quiet    []Window
+
+	// Rand returns a random number in [0.0,1.0) for the jitter,
+	// defaults to rand.Float64.
+	Rand func() float64
+}
+
+// Defer moves t to the end of the quiet window that contains it.
+func (s *Schedule) Defer(t time.Time) time.Time {
+	// Windows can overlap, so repeat until t is not quiet anymore.
+	for range len(s.Quiet) + 1 {
+		moved := false
+		for _, w := range s.Quiet {
+			if end, quiet := w.end(t); quiet {
+				t = end
+				moved = true
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+	return t
+}
+
+// Next returns the time of the next poll after now.
+func (s *Schedule) Next(now time.Time) time.Time {
+	if len(s.Entries) == 0 {
+		return s.Defer(now.Add(s.Interval))
+	}
+	random := s.Rand
+	if random == nil {
+		random = rand.Float64
+	}
+
+	// Skip the times in the quiet windows.
+	from := now
+	for range 1000 {
+		var next time.Time
+		for _, e := range s.Entries {
+			t := e.Cron.Next(from)
+			if t.IsZero() {
+				continue
+			}
+			t = t.Add(time.Duration(random() * float64(e.Jitter)))
+			if next.IsZero() || t.Before(next) {
+				next = t
+			}
+		}
+		if next.IsZero() {
+			break
+		}
+		deferred := s.Defer(next)
+		if deferred.Equal(next) {
+			return next
+		}
+		from = deferred.Add(-time.Minute)
+	}
+	// Nothing matches, fall back to the interval.
+	return s.Defer(now.Add(s.Interval))
+}
@@ -0,0 +1,113 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// Monday
+	now := time.Date(2024, 1, 1, 17, 58, 30, 0, time.UTC)
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{expr: "* * * * *", want: time.Date(2024, 1, 1, 17, 59, 0, 0, time.UTC)},
+		{expr: "*/15 * * * *", want: time.Date(2024, 1, 1, 18, 0, 0, 0, time.UTC)},
+		{expr: "* 8-17 * * 1-5", want: time.Date(2024, 1, 1, 17, 59, 0, 0, time.UTC)},
+		{expr: "0 8 * * 1-5", want: time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC)},
+		{expr: "30 6 * * 0", want: time.Date(2024, 1, 7, 6, 30, 0, 0, time.UTC)},
+		{expr: "30 6 * * 7", want: time.Date(2024, 1, 7, 6, 30, 0, 0, time.UTC)},
+		{expr: "0 0 1 3 *", want: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 29 2 *", want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Day of month or day of week.
+		{expr: "0 12 15 * 3", want: time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		t.Run(c.expr, func(t *testing.T) {
+			cron, err := ParseCron(c.expr)
+			if err != nil {
+				t.Fatalf("parse error: %s", err.Error())
+			}
+			if got := cron.Next(now); !got.Equal(c.want) {
+				t.Errorf("want %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("want error for %q", expr)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	entries, err := ParseEntries("* 8-17 * * 1-5 30s; 0 * * * *")
+	if err != nil {
+		t.Fatalf("parse error: %s", err.Error())
+	}
+	if entries[0].Jitter != 30*time.Second || entries[1].Jitter != 0 {
+		t.Errorf("unexpected jitter: %v, %v", entries[0].Jitter, entries[1].Jitter)
+	}
+	quiet, err := ParseWindows("22:00-06:00")
+	if err != nil {
+		t.Fatalf("parse error: %s", err.Error())
+	}
+	s := &Schedule{
+		Entries:  entries,
+		Interval: time.Hour,
+		Quiet:    quiet,
+		Rand:     func() float64 { return 0.5 },
+	}
+
+	cases := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{
+			name: "office hours",
+			now:  time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 1, 1, 10, 1, 15, 0, time.UTC),
+		},
+		{
+			name: "evening",
+			now:  time.Date(2024, 1, 1, 20, 10, 0, 0, time.UTC),
+			want: time.Date(2024, 1, 1, 21, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "quiet hours",
+			now:  time.Date(2024, 1, 1, 21, 30, 0, 0, time.UTC),
+			want: time.Date(2024, 1, 2, 6, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := s.Next(c.now); !got.Equal(c.want) {
+				t.Errorf("want %v, got %v", c.want, got)
+			}
+		})
+	}
+
+	// The interval is used without entries.
+	s.Entries = nil
+	now := time.Date(2024, 1, 1, 21, 30, 0, 0, time.UTC)
+	if got, want := s.Next(now), time.Date(2024, 1, 2, 6, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if got := s.Defer(time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)); !got.Equal(time.Date(2024, 1, 2, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("want end of quiet hours, got %v", got)
+	}
+}
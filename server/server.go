@@ -1,32 +1,50 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"io/fs"
 	"iter"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/url"
 	"sync"
 	"time"
+
+	"github.com/myhops/bbfsserver/handlers/cache"
+	"github.com/myhops/bbfsserver/handlers/settable"
 )
 
 const (
 	pathVersions = "/versions"
 	pathAll      = "/all"
+	pathStatic   = "/static"
 )
 
 type Version struct {
 	Name string
 	Dir  fs.FS
+	// CommitID is the commit of the version, it is used for the ETag, optional.
+	CommitID string
+	// Modified returns the commit date for Last-Modified, optional.
+	// ctx is the context of the request, the zero time means unknown.
+	Modified func(ctx context.Context) time.Time
 }
 
 type Server struct {
 	serveMux http.ServeMux
 	logger   *slog.Logger
 	all      fs.FS
-	versions []*Version
+
+	// versionsMtx protects versions and versionRoutes.
+	versionsMtx   sync.RWMutex
+	versions      []*Version
+	versionRoutes map[string]*versionRoute
+
+	// allHandler serves all, SetAll replaces it.
+	allHandler settable.Settable
 
 	// timeToLive
 	ttlMutex   sync.RWMutex
@@ -34,13 +52,19 @@ type Server struct {
 	startTime  time.Time
 
 	cacheMiddleware func(next http.Handler) http.Handler
+
+	// webFS and indexTemplate are kept for Derive.
+	webFS         fs.FS
+	indexTemplate string
+	// staticHandler serves webFS, Derive shares it.
+	staticHandler http.Handler
 }
 
 // Tags returns an iterator, go 1.23.0, just for the fun of it.
 // func (s *Server) Versions() func(yield func(string) bool) bool {
 func (s *Server) Versions() iter.Seq[string] {
 	return func(yield func(string) bool) {
-		for _, v := range s.versions {
+		for _, v := range s.GetVersions() {
 			if !yield(v.Name) {
 				return
 			}
@@ -50,8 +74,9 @@ func (s *Server) Versions() iter.Seq[string] {
 
 // GetVersionNames returns an array with the prefixes of the tags
 func (s *Server) GetVersionNames() []string {
-	res := make([]string, 0, len(s.versions))
-	for _, t := range s.versions {
+	versions := s.GetVersions()
+	res := make([]string, 0, len(versions))
+	for _, t := range versions {
 		res = append(res, t.Name)
 	}
 	return res
@@ -79,7 +104,7 @@ func New(
 	if cacheMiddleware == nil {
 		cacheMiddleware = func(next http.Handler) http.Handler {
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				next.ServeHTTP(w,r)
+				next.ServeHTTP(w, r)
 			})
 		}
 	}
@@ -87,42 +112,102 @@ func New(
 		serveMux:        *http.NewServeMux(),
 		logger:          logger,
 		all:             all,
-		versions:        versions,
 		timeToLive:      timeToLive,
 		startTime:       time.Now(),
 		cacheMiddleware: cacheMiddleware,
+		webFS:           webFS,
+		indexTemplate:   indexTemplate,
 	}
+	s.staticHandler = cacheMiddleware(http.FileServerFS(webFS))
+	s.allHandler.SetLogger(logger.With(slog.String("handler", "all")))
+	s.SetVersions(versions)
 	s.routes(webFS, indexTemplate, getInfo)
 
 	return s
 }
 
+// Derive returns a new server with versions and getInfo for the index page.
+// The new server shares the handler for the main branch and the handlers of
+// the versions that are present in both with s, so it keeps their cached responses.
+// s is not changed, this allows the new server to be checked before it is used.
+func (s *Server) Derive(versions []*Version, getInfo func() (*IndexPageInfo, error)) *Server {
+	s.versionsMtx.RLock()
+	routes := maps.Clone(s.versionRoutes)
+	s.versionsMtx.RUnlock()
+	s.ttlMutex.RLock()
+	timeToLive, startTime := s.timeToLive, s.startTime
+	s.ttlMutex.RUnlock()
+
+	ns := &Server{
+		serveMux:        *http.NewServeMux(),
+		logger:          s.logger,
+		all:             s.all,
+		versionRoutes:   routes,
+		timeToLive:      timeToLive,
+		startTime:       startTime,
+		cacheMiddleware: s.cacheMiddleware,
+		webFS:           s.webFS,
+		indexTemplate:   s.indexTemplate,
+		staticHandler:   s.staticHandler,
+	}
+	ns.allHandler.SetLogger(s.logger.With(slog.String("handler", "all")))
+	ns.SetVersions(versions)
+	ns.allHandler.Set(s.allHandler.Get())
+	ns.routes(s.webFS, s.indexTemplate, getInfo)
+	return ns
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.setCacheControl(w.Header())
 	s.serveMux.ServeHTTP(w, r)
 }
 
-func (s *Server) addPrefixFSRoute(prefix string, version *Version) {
-	// create the path.
-	p, _ := url.JoinPath(prefix, "/", version.Name, "/")
-	// add the handler to the serve mux
-	s.serveMux.Handle(fmt.Sprintf("GET %s", p), s.cacheMiddleware(http.StripPrefix(p, http.FileServerFS(version.Dir))))
-	s.logger.Info("added prefix FS", "path", p)
-}
-
 func (s *Server) addVersionRoutes(prefix string) {
-	for _, p := range s.versions {
-		s.addPrefixFSRoute(prefix, p)
-	}
+	p, _ := url.JoinPath(prefix, "/")
+	s.serveMux.Handle(fmt.Sprintf("GET %s", p), http.HandlerFunc(s.serveVersion))
 }
 
 func (s *Server) addAllRoute(prefix string, fs fs.FS) {
 	logger := s.logger.With(slog.String("handler", "addAllHandler"))
 	p, _ := url.JoinPath(prefix, "/")
-	s.serveMux.Handle(fmt.Sprintf("GET %s", p), s.cacheMiddleware(http.StripPrefix(p, http.FileServerFS(fs))))
+	// Derive sets the handler of the server it derives from.
+	if s.allHandler.Get() == nil {
+		s.allHandler.Set(s.cacheMiddleware(http.StripPrefix(p, http.FileServerFS(fs))))
+	}
+	s.serveMux.Handle(fmt.Sprintf("GET %s", p), withCacheLabels(cache.Labels{Route: pathAll}, &s.allHandler))
 	logger.Info("added unversioned handler", "path", p)
 }
 
+// SetAll replaces the FS for the main branch.
+// The new FS gets its own cache keys and the cached responses for the old FS are dropped.
+func (s *Server) SetAll(fs fs.FS) {
+	p, _ := url.JoinPath(pathAll, "/")
+	old := s.allHandler.Get()
+	s.allHandler.Set(s.cacheMiddleware(http.StripPrefix(p, http.FileServerFS(fs))))
+	n := 0
+	if old != nil {
+		n = cache.Release(old)
+	}
+	s.logger.Info("replaced unversioned handler", "path", p, "dropped", n)
+}
+
+// Retire drops the cached responses of the versions of s that next does not share,
+// call it when next replaces s. The versions that did not change keep their responses.
+func (s *Server) Retire(next *Server) {
+	s.versionsMtx.RLock()
+	routes := maps.Clone(s.versionRoutes)
+	s.versionsMtx.RUnlock()
+	next.versionsMtx.RLock()
+	defer next.versionsMtx.RUnlock()
+	for name, r := range routes {
+		if next.versionRoutes[name] == r {
+			continue
+		}
+		n := cache.Release(r.cached)
+		s.logger.Info("dropped cached responses of version", "name", name, "dropped", n)
+	}
+}
+
 func (s *Server) routes(
 	webFS fs.FS,
 	indexTemplate string,
@@ -132,7 +217,14 @@ func (s *Server) routes(
 	s.addVersionRoutes(pathVersions)
 	s.addAllRoute(pathAll, s.all)
 	s.serveMux.Handle("GET /", s.indexPageHandler(indexTemplate, getinfo))
-	s.serveMux.Handle("GET /static/", http.FileServerFS(webFS))
+	s.serveMux.Handle("GET "+pathStatic+"/", withCacheLabels(cache.Labels{Route: pathStatic}, s.staticHandler))
+}
+
+// withCacheLabels sets the labels for the cache statistics on the requests for next.
+func withCacheLabels(labels cache.Labels, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(cache.WithLabels(r.Context(), labels)))
+	})
 }
 
 type IndexPageInfo struct {
@@ -140,7 +232,9 @@ type IndexPageInfo struct {
 	BitbucketURL   string
 	ProjectKey     string
 	RepositorySlug string
-	Versions       []struct {
+	// Message is shown above the versions when set, e.g. when the versions are not available.
+	Message  string
+	Versions []struct {
 		Name string
 		Path string
 	}
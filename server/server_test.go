@@ -1,9 +1,20 @@
 package server
 
 import (
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"slices"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/myhops/bbfsserver/handlers/cache"
 )
 
 func getIndexPageInfo(
@@ -75,3 +86,192 @@ func TestIteratorSignature(t *testing.T) {
 		}
 	}
 }
+
+func TestSetAll(t *testing.T) {
+	get := func(s *Server) string {
+		r := httptest.NewRequest(http.MethodGet, "/all/file.txt", nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		body, _ := io.ReadAll(w.Result().Body)
+		return string(body)
+	}
+
+	old := fstest.MapFS{"file.txt": &fstest.MapFile{Data: []byte("old")}}
+	s := New(slog.Default(), old, nil, fstest.MapFS{}, "", getIndexPageInfo("", "", "", "", nil), time.Minute, nil)
+	if got := get(s); got != "old" {
+		t.Errorf("want old, got %s", got)
+	}
+
+	s.SetAll(fstest.MapFS{"file.txt": &fstest.MapFile{Data: []byte("new")}})
+	if got := get(s); got != "new" {
+		t.Errorf("want new, got %s", got)
+	}
+}
+
+func TestSetVersions(t *testing.T) {
+	get := func(s *Server, path string) (int, string) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		body, _ := io.ReadAll(w.Result().Body)
+		return w.Code, string(body)
+	}
+	file := func(data string) fs.FS {
+		return fstest.MapFS{"file.txt": &fstest.MapFile{Data: []byte(data)}}
+	}
+
+	// Count the handlers that the cache middleware wraps.
+	var wrapped int
+	cacheMiddleware := func(next http.Handler) http.Handler {
+		wrapped++
+		return next
+	}
+
+	v1 := &Version{Name: "m1/v1", Dir: file("v1")}
+	v2 := &Version{Name: "m1/v2", Dir: file("v2")}
+	s := New(slog.Default(), fstest.MapFS{}, []*Version{v1, v2}, fstest.MapFS{}, "",
+		getIndexPageInfo("", "", "", "", nil), time.Minute, cacheMiddleware)
+	// Two versions, all and static.
+	if wrapped != 4 {
+		t.Fatalf("want 4 wrapped handlers, got %d", wrapped)
+	}
+	if _, body := get(s, "/versions/m1/v1/file.txt"); body != "v1" {
+		t.Errorf("want v1, got %s", body)
+	}
+
+	// Keep v2, replace v1 and add v3.
+	v1moved := &Version{Name: "m1/v1", Dir: file("v1 moved")}
+	v3 := &Version{Name: "m1/v3", Dir: file("v3")}
+	s.SetVersions([]*Version{v3, v2, v1moved})
+	if wrapped != 6 {
+		t.Errorf("want 6 wrapped handlers, got %d", wrapped)
+	}
+	if _, body := get(s, "/versions/m1/v1/file.txt"); body != "v1 moved" {
+		t.Errorf("want v1 moved, got %s", body)
+	}
+	if _, body := get(s, "/versions/m1/v3/file.txt"); body != "v3" {
+		t.Errorf("want v3, got %s", body)
+	}
+	if got := s.GetVersionNames(); !slices.Equal(got, []string{"m1/v3", "m1/v2", "m1/v1"}) {
+		t.Errorf("unexpected versions: %v", got)
+	}
+
+	if !s.RemoveVersion("m1/v2") {
+		t.Errorf("want m1/v2 removed")
+	}
+	if code, _ := get(s, "/versions/m1/v2/file.txt"); code != http.StatusNotFound {
+		t.Errorf("want %d, got %d", http.StatusNotFound, code)
+	}
+	if code, _ := get(s, "/versions/m1/v3"); code != http.StatusMovedPermanently {
+		t.Errorf("want %d, got %d", http.StatusMovedPermanently, code)
+	}
+}
+
+func TestDerive(t *testing.T) {
+	get := func(s *Server, path string) (int, string) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		body, _ := io.ReadAll(w.Result().Body)
+		return w.Code, string(body)
+	}
+	file := func(data string) fs.FS {
+		return fstest.MapFS{"file.txt": &fstest.MapFile{Data: []byte(data)}}
+	}
+
+	var wrapped int
+	cacheMiddleware := func(next http.Handler) http.Handler {
+		wrapped++
+		return next
+	}
+
+	v1 := &Version{Name: "m1/v1", Dir: file("v1")}
+	s := New(slog.Default(), file("all"), []*Version{v1}, fstest.MapFS{}, "",
+		getIndexPageInfo("", "", "", "", nil), time.Minute, cacheMiddleware)
+
+	v2 := &Version{Name: "m1/v2", Dir: file("v2")}
+	ns := s.Derive([]*Version{v2, v1}, getIndexPageInfo("", "", "", "", nil))
+	// Only v2 is new.
+	if wrapped != 4 {
+		t.Errorf("want 4 wrapped handlers, got %d", wrapped)
+	}
+	if _, body := get(ns, "/versions/m1/v2/file.txt"); body != "v2" {
+		t.Errorf("want v2, got %s", body)
+	}
+	if _, body := get(ns, "/all/file.txt"); body != "all" {
+		t.Errorf("want all, got %s", body)
+	}
+	// The original server is not changed.
+	if code, _ := get(s, "/versions/m1/v2/file.txt"); code != http.StatusNotFound {
+		t.Errorf("want %d, got %d", http.StatusNotFound, code)
+	}
+	if got := s.GetVersionNames(); !slices.Equal(got, []string{"m1/v1"}) {
+		t.Errorf("unexpected versions: %v", got)
+	}
+}
+
+func TestReleaseCachedResponses(t *testing.T) {
+	file := func(data string) fs.FS {
+		return fstest.MapFS{"file.txt": &fstest.MapFile{Data: []byte(data)}}
+	}
+	get := func(s *Server, path string) {
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	c, err := cache.New(cache.Config{MaxBytes: 1 << 20}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	v1 := &Version{Name: "m1/v1", Dir: file("v1")}
+	v2 := &Version{Name: "m1/v2", Dir: file("v2")}
+	s := New(slog.Default(), file("all"), []*Version{v1, v2}, fstest.MapFS{}, "",
+		getIndexPageInfo("", "", "", "", nil), time.Minute, c.Middleware())
+	for _, p := range []string{"/all/file.txt", "/versions/m1/v1/file.txt", "/versions/m1/v2/file.txt"} {
+		get(s, p)
+	}
+
+	// The responses of the old FS for the main branch are dropped.
+	s.SetAll(file("all moved"))
+	if n := c.PurgePrefix("/all/"); n != 0 {
+		t.Errorf("want no responses for /all after SetAll, got %d", n)
+	}
+
+	// Removing v2 drops its responses, v1 keeps them.
+	ns := s.Derive([]*Version{v1}, getIndexPageInfo("", "", "", "", nil))
+	s.Retire(ns)
+	if n := c.PurgePrefix("/versions/"); n != 1 {
+		t.Errorf("want 1 version response after Retire, got %d", n)
+	}
+}
+
+func TestVersionValidators(t *testing.T) {
+	committed := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	v := &Version{
+		Name:     "m1/v1",
+		Dir:      fstest.MapFS{"file.txt": &fstest.MapFile{Data: []byte("v1")}},
+		CommitID: "c0ffee",
+		Modified: func(context.Context) time.Time { return committed },
+	}
+	s := New(slog.Default(), fstest.MapFS{}, []*Version{v}, fstest.MapFS{}, "",
+		getIndexPageInfo("", "", "", "", nil), time.Minute, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/versions/m1/v1/file.txt", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"c0ffee-`) {
+		t.Errorf("want ETag with commit, got %s", etag)
+	}
+	if got := w.Header().Get("Last-Modified"); got != committed.Format(http.TimeFormat) {
+		t.Errorf("want Last-Modified %s, got %s", committed.Format(http.TimeFormat), got)
+	}
+
+	// Without cache the file server answers the condition.
+	r = httptest.NewRequest(http.MethodGet, "/versions/m1/v1/file.txt", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("want %d, got %d", http.StatusNotModified, w.Code)
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/myhops/bbfsserver/handlers/cache"
+)
+
+// versionRoute is the handler for a version.
+type versionRoute struct {
+	version *Version
+	handler http.Handler
+	// cached is the handler of the cache, it is released when the route is removed.
+	cached http.Handler
+}
+
+// newVersionRoute creates the handler for version,
+// each route has its own cache.
+func (s *Server) newVersionRoute(version *Version) *versionRoute {
+	p, _ := url.JoinPath(pathVersions, "/", version.Name, "/")
+	h := s.cacheMiddleware(withValidators(version, http.StripPrefix(p, http.FileServerFS(version.Dir))))
+	labels := cache.Labels{Route: pathVersions, Version: version.Name}
+	return &versionRoute{
+		version: version,
+		handler: withCacheLabels(labels, withPersistentKey(version, p, h)),
+		cached:  h,
+	}
+}
+
+// withPersistentKey marks the requests for version as immutable for the cache,
+// the key is the commit and the path below prefix, so it survives rebuilds and restarts.
+func withPersistentKey(version *Version, prefix string, next http.Handler) http.Handler {
+	if version.CommitID == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(cache.WithPersistentKey(r.Context(), version.CommitID, prefix)))
+	})
+}
+
+// withValidators sets the ETag and Last-Modified for the commit of version
+// on the responses of next. The content of a path in a commit never changes,
+// so the commit and the path make a strong ETag.
+func withValidators(version *Version, next http.Handler) http.Handler {
+	if version.CommitID == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := sha256.Sum256([]byte(r.URL.Path))
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-%x"`, version.CommitID, h[:8]))
+		if version.Modified != nil {
+			if t := version.Modified(r.Context()); !t.IsZero() {
+				w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GetVersions returns a copy of the list of versions.
+func (s *Server) GetVersions() []*Version {
+	s.versionsMtx.RLock()
+	defer s.versionsMtx.RUnlock()
+	return slices.Clone(s.versions)
+}
+
+// SetVersions replaces the versions.
+// Versions that are already present keep their handler and their cached responses,
+// a version is present if the same *Version was added before.
+// The change is atomic for concurrent requests.
+func (s *Server) SetVersions(versions []*Version) {
+	s.versionsMtx.Lock()
+	defer s.versionsMtx.Unlock()
+
+	routes := make(map[string]*versionRoute, len(versions))
+	for _, v := range versions {
+		if r, found := s.versionRoutes[v.Name]; found && r.version == v {
+			routes[v.Name] = r
+			continue
+		}
+		routes[v.Name] = s.newVersionRoute(v)
+		s.logger.Info("added version", "name", v.Name)
+	}
+	for name := range s.versionRoutes {
+		if _, found := routes[name]; !found {
+			s.logger.Info("removed version", "name", name)
+		}
+	}
+	s.versions = slices.Clone(versions)
+	s.versionRoutes = routes
+}
+
+// AddVersion adds version in front of the other versions,
+// an existing version with the same name is replaced.
+func (s *Server) AddVersion(version *Version) {
+	versions := s.GetVersions()
+	versions = slices.DeleteFunc(versions, func(v *Version) bool {
+		return v.Name == version.Name
+	})
+	s.SetVersions(append([]*Version{version}, versions...))
+}
+
+// RemoveVersion removes the version with name and returns true if it was present.
+func (s *Server) RemoveVersion(name string) bool {
+	versions := s.GetVersions()
+	n := len(versions)
+	versions = slices.DeleteFunc(versions, func(v *Version) bool {
+		return v.Name == name
+	})
+	if len(versions) == n {
+		return false
+	}
+	s.SetVersions(versions)
+	return true
+}
+
+// findVersionRoute returns the route for the longest version name that is a prefix of p.
+// p is the path without /versions/.
+func (s *Server) findVersionRoute(p string) (*versionRoute, string) {
+	s.versionsMtx.RLock()
+	defer s.versionsMtx.RUnlock()
+
+	for i := len(p); i > 0; i = strings.LastIndex(p[:i], "/") {
+		if r, found := s.versionRoutes[p[:i]]; found {
+			return r, p[:i]
+		}
+	}
+	return nil, ""
+}
+
+// serveVersion passes the request to the handler of the version in the path.
+func (s *Server) serveVersion(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, pathVersions+"/")
+	route, name := s.findVersionRoute(p)
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+	// Redirect to the directory like http.ServeMux does.
+	if p == name {
+		u := *r.URL
+		u.Path += "/"
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+	route.handler.ServeHTTP(w, r)
+}